@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// apiClientSettings are the reloadable settings the API client is built with
+var apiClientSettings = []string{"api-timeout", "api-connect-timeout"}
+
+// newAPIHTTPClient builds the HTTP client used for the Linode API from the
+// api-* settings
+func newAPIHTTPClient(c *Config) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if c.APIProxy != "" {
+		proxyURL, err := url.Parse(c.APIProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid api-proxy: %s", redactError(err))
+		}
+		// credentials in the URL are sent as Proxy-Authorization
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if c.APICAFile != "" {
+		pem, err := os.ReadFile(c.APICAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read api-ca-file: %s", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("api-ca-file %s contains no PEM certificates", c.APICAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	if c.APIConnectTimeout > 0 {
+		dialer := &net.Dialer{Timeout: time.Duration(c.APIConnectTimeout) * time.Second, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = time.Duration(c.APIConnectTimeout) * time.Second
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(c.APITimeout) * time.Second,
+	}, nil
+}
+
+// registerProxySecret redacts the password of the api-proxy URL from logs
+func registerProxySecret(proxy string) {
+	if proxyURL, err := url.Parse(proxy); err == nil && proxyURL.User != nil {
+		if password, ok := proxyURL.User.Password(); ok {
+			secrets.add(password)
+		}
+	}
+}
+
+// reloadConfig reloads the configuration, rebuilding the API client if any
+// of its settings changed
+func (driver *linodeVolumeDriver) reloadConfig(loader *configLoader) ([]string, error) {
+	changed, err := reloadConfig(loader)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range changed {
+		if slices.Contains(apiClientSettings, name) {
+			driver.rebuildAPIClient()
+			break
+		}
+	}
+	return changed, nil
+}
+
+// rebuildAPIClient replaces the API client with one built from the current
+// configuration. Requests already running finish with the previous client.
+func (driver *linodeVolumeDriver) rebuildAPIClient() {
+	driver.apiMutex.Lock()
+	defer driver.apiMutex.Unlock()
+
+	if driver.linodeAPIPtr == nil {
+		return
+	}
+
+	api, err := setupLinodeAPI(driver.linodeToken)
+	if err != nil {
+		log.Errorf("Failed to rebuild the Linode API client: %s", err)
+		return
+	}
+	driver.linodeAPIPtr = api
+	log.Info("Rebuilt the Linode API client")
+}
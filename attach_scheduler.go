@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// attachRequest is an attach waiting for or holding a scheduler slot
+type attachRequest struct {
+	volumeID int
+	label    string
+	queued   time.Time
+	start    chan struct{}
+	done     chan struct{}
+	err      error
+}
+
+// attachMetrics reports the state of the attach scheduler
+type attachMetrics struct {
+	Concurrency int
+	Running     int
+	QueueDepth  int
+	Scheduled   int
+	Coalesced   int
+	WaitTotal   time.Duration
+	WaitMax     time.Duration
+}
+
+// attachScheduler runs attaches in the order they were requested, at most
+// concurrency at a time. A request for a volume that is already queued or
+// attaching waits for that attach instead of starting another one.
+type attachScheduler struct {
+	mutex       sync.Mutex
+	concurrency int
+	running     int
+	queue       []*attachRequest
+	requests    map[int]*attachRequest
+	metrics     attachMetrics
+}
+
+func newAttachScheduler(concurrency int) *attachScheduler {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &attachScheduler{
+		concurrency: concurrency,
+		requests:    make(map[int]*attachRequest),
+	}
+}
+
+// attach runs attachFn once a slot is free. It returns whether this call
+// attached the volume; coalesced callers only share the error.
+func (s *attachScheduler) attach(volumeID int, label string, attachFn func() (bool, error)) (bool, error) {
+	s.mutex.Lock()
+	if req, ok := s.requests[volumeID]; ok {
+		s.metrics.Coalesced++
+		s.mutex.Unlock()
+
+		log.Infof("Attach of volume %s already requested, waiting for it", label)
+		<-req.done
+		return false, req.err
+	}
+
+	req := &attachRequest{
+		volumeID: volumeID,
+		label:    label,
+		queued:   time.Now(),
+		start:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	s.requests[volumeID] = req
+	s.queue = append(s.queue, req)
+	s.metrics.Scheduled++
+	s.dispatch()
+	position, depth := 0, len(s.queue)
+	for i, r := range s.queue {
+		if r == req {
+			position = i + 1
+		}
+	}
+	s.mutex.Unlock()
+
+	if position > 0 {
+		log.Infof("Queued attach of volume %s at position %d/%d", label, position, depth)
+	}
+
+	<-req.start
+	if wait := time.Since(req.queued); wait >= time.Second {
+		log.Infof("Attaching volume %s after waiting %s", label, wait.Round(time.Millisecond))
+	}
+
+	attached, err := attachFn()
+
+	s.mutex.Lock()
+	req.err = err
+	delete(s.requests, volumeID)
+	s.running--
+	s.dispatch()
+	s.mutex.Unlock()
+	close(req.done)
+
+	return attached, err
+}
+
+// dispatch starts queued requests while slots are free. s.mutex must be held.
+func (s *attachScheduler) dispatch() {
+	for s.running < s.concurrency && len(s.queue) > 0 {
+		req := s.queue[0]
+		s.queue = s.queue[1:]
+		s.running++
+
+		wait := time.Since(req.queued)
+		s.metrics.WaitTotal += wait
+		if wait > s.metrics.WaitMax {
+			s.metrics.WaitMax = wait
+		}
+
+		close(req.start)
+	}
+}
+
+// snapshot returns the current metrics of the scheduler
+func (s *attachScheduler) snapshot() attachMetrics {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m := s.metrics
+	m.Concurrency = s.concurrency
+	m.Running = s.running
+	m.QueueDepth = len(s.queue)
+	return m
+}
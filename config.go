@@ -0,0 +1,520 @@
+package main
+
+//go:generate go run . -generate-plugin-env config.json
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Config holds the settings of the plugin. Every setting is taken, from
+// lowest to highest precedence, from its default, the config file, the
+// environment and the command line. Settings tagged reload can be changed
+// by reloading the configuration, the others require a restart.
+type Config struct {
+	LinodeToken            string `config:"linode-token" secret:"true" usage:"Required Personal Access Token generated in Linode Console."`
+	LinodeTokenFile        string `config:"linode-token-file" usage:"File to read the Personal Access Token from instead, such as a Docker secret. Rotated tokens are picked up."`
+	TokenPreflightStrict   bool   `config:"token-preflight-strict" usage:"If true, the plugin refuses to start when the token lacks a scope or grant it needs."`
+	APIURL                 string `config:"api-url" usage:"Base URL of the Linode API, e.g. of an API gateway (defaults to https://api.linode.com)"`
+	APIVersion             string `config:"api-version" usage:"Version of the Linode API (defaults to v4)"`
+	APIProxy               string `config:"api-proxy" secret:"true" usage:"HTTP(S) proxy for Linode API requests, with optional user:password (defaults to the HTTPS_PROXY environment variable)"`
+	APICAFile              string `config:"api-ca-file" usage:"PEM file of additional CA certificates trusted for Linode API requests"`
+	APITimeout             int    `config:"api-timeout" reload:"true" usage:"Seconds before a Linode API request times out (0 disables the timeout)"`
+	APIConnectTimeout      int    `config:"api-connect-timeout" reload:"true" usage:"Seconds before connecting to the Linode API or the proxy times out"`
+	LinodeLabel            string `config:"linode-label" usage:"Sets the Linode Instance Label (defaults to the OS HOSTNAME)"`
+	LinodeID               int    `config:"linode-id" usage:"Sets the Linode Instance ID"`
+	IdentitySources        string `config:"identity-sources" reload:"true" usage:"Comma separated sources to determine the current Linode from, in order: linode-id,metadata,instance-data,ipv4,ipv6,link-local,label"`
+	IdentityCrossCheck     bool   `config:"identity-cross-check" reload:"true" usage:"If true, every available identity source is queried and they must agree on the Linode ID."`
+	IdentityVerifyInterval int    `config:"identity-verify-interval" usage:"Seconds between checks that this host is still the resolved Linode (0 disables them)"`
+	IdentityAutoResolve    bool   `config:"identity-auto-resolve" reload:"true" usage:"If true, the Linode ID is resolved again when this host is no longer the resolved Linode."`
+	IdentityInterface      string `config:"identity-interface" reload:"true" usage:"The network interface whose link local address identifies the current Linode"`
+	InstanceDataFile       string `config:"instance-data-file" reload:"true" usage:"The cloud-init instance-data file"`
+	ForceAttach            bool   `config:"force-attach" reload:"true" usage:"If true, volumes will be forcibly attached to the current Linode if already attached to another Linode."`
+	ForceRemove            bool   `config:"force-remove" reload:"true" usage:"If true, volumes will be removed even if they are attached to another Linode or mounted."`
+	EvictIdleVolumes       bool   `config:"evict-idle-volumes" reload:"true" usage:"If true, idle volumes will be detached when all volume slots of the current Linode are used."`
+	SocketUser             string `config:"socket-user" usage:"Sets the user to create the socket with."`
+	MountRoot              string `config:"mount-root" usage:"The location to mount volumes to."`
+	StateDir               string `config:"state-dir" usage:"The directory the plugin keeps its state in."`
+	LogLevel               string `config:"log-level" reload:"true" usage:"Sets log level: debug,info,warn,error"`
+	BusyUnmountPolicy      string `config:"busy-unmount-policy" reload:"true" usage:"What to do when a volume is busy on unmount: fail, retry or lazy"`
+	BusyUnmountRetries     int    `config:"busy-unmount-retries" reload:"true" usage:"Number of times to retry unmounting a busy volume with the retry and lazy policies"`
+	ShutdownTimeout        int    `config:"shutdown-timeout" reload:"true" usage:"Seconds to wait for in-flight operations on shutdown"`
+	DetachDelay            int    `config:"detach-delay" reload:"true" usage:"Seconds to keep a volume attached after its last unmount"`
+	VolumeSlots            int    `config:"volume-slots" reload:"true" usage:"Number of volumes the current Linode can attach (defaults to the limit of its plan)"`
+	AttachConcurrency      int    `config:"attach-concurrency" usage:"Number of volumes attached at the same time, further attaches are queued"`
+	LabelPrefix            string `config:"label-prefix" usage:"Prefix added to the Linode label of every volume, so clusters sharing an account and region have separate volume names"`
+	VolumeLabelRegex       string `config:"volume-label-regex" usage:"Only manage volumes whose label matches this regular expression"`
+	VolumeLabelPrefix      string `config:"volume-label-prefix" usage:"Only manage volumes whose label starts with this prefix"`
+	VolumeRequiredTag      string `config:"volume-required-tag" usage:"Only manage volumes with this tag, which is added to the volumes the plugin creates"`
+	DefaultSize            int    `config:"default-size" reload:"true" usage:"Size in GB of volumes created without a size option"`
+	DefaultFilesystem      string `config:"default-filesystem" reload:"true" usage:"Filesystem of volumes created without a filesystem option"`
+	DefaultDeleteOnRemove  bool   `config:"default-delete-on-remove" reload:"true" usage:"If true, volumes created without a delete-on-remove option are deleted when removed."`
+
+	// guard is built from the volume-* settings when the config is applied
+	guard *volumeGuard
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		APITimeout:             60,
+		APIConnectTimeout:      30,
+		IdentitySources:        "linode-id,metadata,instance-data,label,ipv4,link-local",
+		IdentityVerifyInterval: 600,
+		IdentityInterface:      "eth0",
+		InstanceDataFile:       "/run/cloud-init/instance-data.json",
+		SocketUser:             "root",
+		MountRoot:              "/mnt",
+		StateDir:               "/var/lib/docker-volume-linode",
+		LogLevel:               "info",
+		BusyUnmountPolicy:      busyPolicyFail,
+		BusyUnmountRetries:     5,
+		ShutdownTimeout:        60,
+		AttachConcurrency:      2,
+		DefaultSize:            10,
+		DefaultFilesystem:      defaultFilesystem,
+	}
+}
+
+// currentConfig is the effective configuration, loaded by main and replaced
+// as a whole on reload
+var currentConfig atomic.Pointer[Config]
+
+func init() {
+	applyConfig(defaultConfig())
+}
+
+// config returns the effective configuration. Callers needing several
+// settings that must be consistent should call it once.
+func config() *Config {
+	return currentConfig.Load()
+}
+
+// applyConfig makes c the effective configuration. c must be valid.
+func applyConfig(c *Config) {
+	c.guard, _ = newVolumeGuard(c)
+	currentConfig.Store(c)
+
+	level, _ := log.ParseLevel(c.LogLevel)
+	log.SetLevel(level)
+}
+
+// configLoader loads the configuration from the sources given on startup
+type configLoader struct {
+	file  string
+	fs    *flag.FlagSet
+	flags map[string]*configFlag
+}
+
+func (l *configLoader) load() (*Config, error) {
+	return loadConfig(l.file, l.fs, l.flags)
+}
+
+// reloadMutex serializes reloads
+var reloadMutex sync.Mutex
+
+// reloadConfig loads the configuration again and applies it if every changed
+// setting can be changed at runtime. It returns the changed settings.
+func reloadConfig(loader *configLoader) ([]string, error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	log.Info("Reloading configuration")
+
+	c, err := loader.load()
+	if err = errors.Join(err, c.validate()); err != nil {
+		return nil, err
+	}
+
+	old := config()
+	var changed []string
+	var errs []error
+	for _, s := range settings {
+		if old.get(s) == c.get(s) {
+			continue
+		}
+		if !s.reload {
+			errs = append(errs, fmt.Errorf("%s cannot be changed without restarting the plugin", s.name))
+			continue
+		}
+		changed = append(changed, s.name)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	applyConfig(c)
+	for _, name := range changed {
+		s, _ := lookupSetting(name)
+		log.Infof("Reloaded %s: %s", name, redact(s, c.get(s)))
+	}
+	if len(changed) == 0 {
+		log.Info("Configuration unchanged")
+	}
+	return changed, nil
+}
+
+// setting describes one field of Config
+type setting struct {
+	name   string
+	usage  string
+	secret bool
+	reload bool
+	field  int
+}
+
+var settings = func() []setting {
+	t := reflect.TypeOf(Config{})
+	var s []setting
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("config") == "" {
+			continue
+		}
+		s = append(s, setting{
+			name:   f.Tag.Get("config"),
+			usage:  f.Tag.Get("usage"),
+			secret: f.Tag.Get("secret") == "true",
+			reload: f.Tag.Get("reload") == "true",
+			field:  i,
+		})
+	}
+	return s
+}()
+
+func lookupSetting(name string) (setting, bool) {
+	for _, s := range settings {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// set parses value into the field of s
+func (c *Config) set(s setting, value string) error {
+	v := reflect.ValueOf(c).Elem().Field(s.field)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid integer %q", s.name, value)
+		}
+		v.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s: invalid boolean %q", s.name, value)
+		}
+		v.SetBool(b)
+	}
+	return nil
+}
+
+// get formats the field of s
+func (c *Config) get(s setting) string {
+	return fmt.Sprint(reflect.ValueOf(c).Elem().Field(s.field).Interface())
+}
+
+// configFlag is the command line flag of a setting. It only records the raw
+// value, which is applied after the config file and the environment.
+type configFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *configFlag) String() string     { return f.value }
+func (f *configFlag) Set(v string) error { f.value = v; return nil }
+func (f *configFlag) IsBoolFlag() bool   { return f.isBool }
+
+// registerConfigFlags adds a flag for every setting to fs
+func registerConfigFlags(fs *flag.FlagSet) map[string]*configFlag {
+	defaults := defaultConfig()
+	t := reflect.TypeOf(Config{})
+
+	flags := make(map[string]*configFlag, len(settings))
+	for _, s := range settings {
+		f := &configFlag{isBool: t.Field(s.field).Type.Kind() == reflect.Bool}
+		fs.Var(f, s.name, s.usage)
+		fs.Lookup(s.name).DefValue = defaults.get(s)
+		flags[s.name] = f
+	}
+	return flags
+}
+
+// loadConfig builds the configuration from the defaults, the config file
+// (if any), the environment and the flags set on fs. All invalid values are
+// reported at once.
+func loadConfig(file string, fs *flag.FlagSet, flags map[string]*configFlag) (*Config, error) {
+	c := defaultConfig()
+	var errs []error
+
+	if file != "" {
+		values, err := readConfigFile(file)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, s := range settings {
+			if value, ok := values[s.name]; ok {
+				if err := c.set(s, value); err != nil {
+					errs = append(errs, fmt.Errorf("%s: %s", file, err))
+				}
+			}
+		}
+	}
+
+	// The plugin environment can only hold values, so empty ones are unset
+	for _, s := range settings {
+		if value, ok := getEnv(s.name); ok && value != "" {
+			if err := c.set(s, value); err != nil {
+				errs = append(errs, fmt.Errorf("environment: %s", err))
+			}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if s, ok := lookupSetting(f.Name); ok {
+			if err := c.set(s, flags[f.Name].value); err != nil {
+				errs = append(errs, fmt.Errorf("flag: %s", err))
+			}
+		}
+	})
+
+	return c, errors.Join(errs...)
+}
+
+// readConfigFile reads the settings of a flat YAML (key: value) or TOML
+// (key = value) file. Keys may use dashes or underscores.
+func readConfigFile(file string) (map[string]string, error) {
+	var sep string
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		sep = ":"
+	case ".toml":
+		sep = "="
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file format, use .yaml, .yml or .toml", file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %s", err)
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	var errs []error
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, sep)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s:%d: expected key%svalue", file, n, sep))
+			continue
+		}
+
+		key = strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+		if _, ok := lookupSetting(key); !ok {
+			errs = append(errs, fmt.Errorf("%s:%d: unknown setting %q", file, n, key))
+			continue
+		}
+
+		value, err := parseConfigValue(strings.TrimSpace(value))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %s", file, n, err))
+			continue
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to read config file: %s", err))
+	}
+
+	return values, errors.Join(errs...)
+}
+
+// parseConfigValue unquotes a scalar value and strips trailing comments
+func parseConfigValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := strings.LastIndex(value, `"`)
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strconv.Unquote(value[:end+1])
+	case strings.HasPrefix(value, "'"):
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return value[1:end], nil
+	}
+
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
+
+// validate checks every setting, reporting all problems at once
+func (c *Config) validate() error {
+	var errs []error
+
+	if c.LinodeToken == "" && c.LinodeTokenFile == "" {
+		errs = append(errs, errors.New("linode-token or linode-token-file is required"))
+	} else if c.LinodeToken != "" && c.LinodeTokenFile != "" {
+		errs = append(errs, errors.New("only one of linode-token and linode-token-file may be set"))
+	}
+
+	if c.APIURL != "" {
+		if u, err := url.Parse(c.APIURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("api-url must be an absolute URL, got %q", c.APIURL))
+		}
+	}
+	if c.APIProxy != "" {
+		if u, err := url.Parse(c.APIProxy); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, errors.New("api-proxy must be an absolute URL"))
+		}
+	}
+	if c.APICAFile != "" {
+		if _, err := os.Stat(c.APICAFile); err != nil {
+			errs = append(errs, fmt.Errorf("api-ca-file: %s", err))
+		}
+	}
+
+	if _, err := log.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log-level: %s", err))
+	}
+
+	switch c.BusyUnmountPolicy {
+	case busyPolicyFail, busyPolicyRetry, busyPolicyLazy:
+	default:
+		errs = append(errs, fmt.Errorf("busy-unmount-policy must be one of fail, retry or lazy, got %q", c.BusyUnmountPolicy))
+	}
+
+	if _, err := parseIdentitySources(c.IdentitySources); err != nil {
+		errs = append(errs, fmt.Errorf("identity-sources: %s", err))
+	}
+
+	for name, value := range map[string]int{
+		"linode-id":                c.LinodeID,
+		"api-timeout":              c.APITimeout,
+		"api-connect-timeout":      c.APIConnectTimeout,
+		"identity-verify-interval": c.IdentityVerifyInterval,
+		"busy-unmount-retries":     c.BusyUnmountRetries,
+		"shutdown-timeout":         c.ShutdownTimeout,
+		"detach-delay":             c.DetachDelay,
+		"volume-slots":             c.VolumeSlots,
+		"default-size":             c.DefaultSize,
+	} {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %d", name, value))
+		}
+	}
+
+	if len(c.LabelPrefix) >= maxLabelLength || !labelPrefixPattern.MatchString(c.LabelPrefix) {
+		errs = append(errs, fmt.Errorf("label-prefix must be shorter than %d characters and only contain letters, digits, '-', '_' and '.', got %q",
+			maxLabelLength, c.LabelPrefix))
+	}
+
+	if _, err := newVolumeGuard(c); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.AttachConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("attach-concurrency must be at least 1, got %d", c.AttachConcurrency))
+	}
+
+	return errors.Join(errs...)
+}
+
+// print writes the configuration in the TOML config file format, with
+// secrets redacted
+func (c *Config) print(w io.Writer) {
+	for _, s := range settings {
+		value := redact(s, c.get(s))
+		if reflect.ValueOf(c).Elem().Field(s.field).Kind() == reflect.String {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(w, "%s = %s\n", s.name, value)
+	}
+}
+
+// redact hides the value of secret settings
+func redact(s setting, value string) string {
+	if s.secret && value != "" {
+		return redacted
+	}
+	return value
+}
+
+// writePluginEnv replaces the env section of the plugin config.json at file
+// with the config file entry and one entry per setting. Settings are left
+// empty, i.e. unset, so that the config file can provide them.
+func writePluginEnv(file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	const envStart, envEnd = "\"env\": [\n", "\n  ],"
+	start := strings.Index(string(b), envStart)
+	if start < 0 {
+		return fmt.Errorf("%s has no env section", file)
+	}
+	start += len(envStart)
+	end := strings.Index(string(b[start:]), envEnd)
+	if end < 0 {
+		return fmt.Errorf("%s has no end of the env section", file)
+	}
+	end += start
+
+	entry := func(name, value string) string {
+		n, _ := json.Marshal(name)
+		v, _ := json.Marshal(value)
+		return fmt.Sprintf("    { \"name\": %s,  \"settable\": [ \"value\" ], \"value\": %s }", n, v)
+	}
+
+	entries := []string{entry("config-file", pluginConfigFile)}
+	for _, s := range settings {
+		entries = append(entries, entry(s.name, ""))
+	}
+
+	out := string(b[:start]) + strings.Join(entries, ",\n") + string(b[end:])
+	return os.WriteFile(file, []byte(out), 0o644)
+}
+
+func getEnv(name string) (string, bool) {
+	if val, found := os.LookupEnv(name); found {
+		return val, true
+	}
+
+	name = strings.ToUpper(name)
+	name = strings.ReplaceAll(name, "-", "_")
+
+	if val, found := os.LookupEnv(name); found {
+		return val, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/linode/linodego/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// detachDelayTagPrefix records the per-volume detach delay in seconds
+	detachDelayTagPrefix = "docker-volume-detach-delay-"
+
+	// detachRequestTag asks the node holding an idle volume to detach it
+	// before its detach delay is over
+	detachRequestTag = "docker-volume-detach-request"
+
+	// detachIdleTag marks volumes kept attached after their last unmount,
+	// the only ones other nodes request a detach of
+	detachIdleTag = "docker-volume-idle"
+
+	// detachRequestPollInterval is how often idle volumes are checked for
+	// detach requests of other nodes
+	detachRequestPollInterval = 5 * time.Second
+
+	// detachRequestTimeout is how long a node waits for the holder of a
+	// volume to honor its detach request
+	detachRequestTimeout = 90 * time.Second
+)
+
+// pendingDetach is a volume kept attached after its last unmount
+type pendingDetach struct {
+	cancel chan struct{}
+	now    chan struct{}
+}
+
+// volumeDetachDelay returns how long a volume stays attached after its last
+// unmount, from its tags or the plugin-wide setting
+func (driver *linodeVolumeDriver) volumeDetachDelay(linVol *linodego.Volume) time.Duration {
+	for _, tag := range linVol.Tags {
+		if !strings.HasPrefix(tag, detachDelayTagPrefix) {
+			continue
+		}
+		seconds, err := strconv.Atoi(tag[len(detachDelayTagPrefix):])
+		if err != nil {
+			log.Warnf("Ignoring invalid tag %s of volume %s", tag, linVol.Label)
+			break
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(config().DetachDelay) * time.Second
+}
+
+// scheduleDetach detaches an idle volume in the background once delay is
+// over, or earlier if another node requests it. While shutting down, the
+// volume is detached right away.
+func (driver *linodeVolumeDriver) scheduleDetach(linVol *linodego.Volume, delay time.Duration) {
+	driver.lifecycleMutex.Lock()
+	if driver.stopping {
+		delay = 0
+	}
+	driver.lifecycleMutex.Unlock()
+
+	driver.detachMutex.Lock()
+	defer driver.detachMutex.Unlock()
+
+	if _, ok := driver.pendingDetaches[linVol.ID]; ok {
+		return
+	}
+
+	pending := &pendingDetach{cancel: make(chan struct{}), now: make(chan struct{})}
+	driver.pendingDetaches[linVol.ID] = pending
+
+	if delay > 0 {
+		log.Infof("Keeping volume %s attached for %s", linVol.Label, delay)
+	}
+
+	// shutdown waits for pending detaches like for any other operation
+	driver.inflight.Add(1)
+	go func() {
+		defer driver.inflight.Done()
+		driver.runDelayedDetach(*linVol, delay, pending)
+	}()
+}
+
+// resumeIdleDetaches schedules again the detaches of idle volumes kept
+// attached to this node before the plugin restarted. Their delay starts
+// over.
+func (driver *linodeVolumeDriver) resumeIdleDetaches(api *linodego.Client) {
+	linVols, err := api.ListInstanceVolumes(context.Background(), driver.instanceID(), nil)
+	if err != nil {
+		log.Errorf("Failed to list volumes attached to linode %d: %s", driver.instanceID(), err)
+		return
+	}
+
+	guard := driver.volumeGuard()
+	for i := range linVols {
+		linVol := &linVols[i]
+		if !hasTag(linVol.Tags, detachIdleTag) || !guard.allows(linVol) {
+			continue
+		}
+
+		mounted, err := isMounted(driver.labelToMountPoint(linVol.Label))
+		if err != nil {
+			log.Warnf("Failed to check whether idle volume %s is mounted: %s", linVol.Label, err)
+			continue
+		}
+		if mounted {
+			// in use again, so no longer idle
+			driver.setIdleMark(linVol, false)
+			continue
+		}
+
+		driver.scheduleDetach(linVol, driver.volumeDetachDelay(linVol))
+	}
+}
+
+// cancelDetach cancels the pending detach of a volume, returning whether
+// there was one
+func (driver *linodeVolumeDriver) cancelDetach(volumeID int) bool {
+	driver.detachMutex.Lock()
+	defer driver.detachMutex.Unlock()
+
+	pending, ok := driver.pendingDetaches[volumeID]
+	if !ok {
+		return false
+	}
+
+	close(pending.cancel)
+	delete(driver.pendingDetaches, volumeID)
+	return true
+}
+
+// hasPendingDetach returns whether a volume is kept attached while idle
+func (driver *linodeVolumeDriver) hasPendingDetach(volumeID int) bool {
+	driver.detachMutex.Lock()
+	defer driver.detachMutex.Unlock()
+
+	_, ok := driver.pendingDetaches[volumeID]
+	return ok
+}
+
+// flushDetaches runs every pending detach right away
+func (driver *linodeVolumeDriver) flushDetaches() {
+	driver.detachMutex.Lock()
+	defer driver.detachMutex.Unlock()
+
+	for _, pending := range driver.pendingDetaches {
+		close(pending.now)
+	}
+}
+
+func (driver *linodeVolumeDriver) runDelayedDetach(linVol linodego.Volume, delay time.Duration, pending *pendingDetach) {
+	// Let other nodes know they may request the volume
+	if delay > 0 {
+		driver.setIdleMark(&linVol, true)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	ticker := time.NewTicker(detachRequestPollInterval)
+	defer ticker.Stop()
+
+	now := pending.now
+wait:
+	for {
+		select {
+		case <-pending.cancel:
+			log.Infof("Volume %s remounted, keeping it attached", linVol.Label)
+			driver.setIdleMark(&linVol, false)
+			return
+		case <-now:
+			now = nil
+			break wait
+		case <-timer.C:
+			break wait
+		case <-ticker.C:
+			if driver.detachRequested(linVol.ID) {
+				log.Infof("Another node requested volume %s, detaching it", linVol.Label)
+				break wait
+			}
+		}
+	}
+
+	// A Mount may have taken the volume over in the meantime
+	driver.detachMutex.Lock()
+	if driver.pendingDetaches[linVol.ID] != pending {
+		driver.detachMutex.Unlock()
+		return
+	}
+	delete(driver.pendingDetaches, linVol.ID)
+	driver.detachMutex.Unlock()
+
+	api, err := driver.linodeAPI()
+	if err != nil {
+		log.Errorf("Failed to detach idle volume %s: %s", linVol.Label, err)
+		return
+	}
+
+	log.Infof("Detaching idle volume %s", linVol.Label)
+	if err := driver.detachVolume(api, &linVol); err != nil {
+		log.Errorf("Failed to detach idle volume %s: %s", linVol.Label, err)
+		return
+	}
+	driver.setIdleMark(&linVol, false)
+}
+
+// setIdleMark sets or clears the tag marking a volume as idle
+func (driver *linodeVolumeDriver) setIdleMark(linVol *linodego.Volume, idle bool) {
+	api, err := driver.linodeAPI()
+	if err == nil {
+		if idle {
+			err = driver.addVolumeTags(api, linVol, detachIdleTag)
+		} else {
+			err = driver.removeVolumeTags(api, linVol, detachIdleTag)
+		}
+	}
+	if err != nil {
+		log.Warnf("Failed to update idle mark of volume %s: %s", linVol.Label, err)
+	}
+}
+
+// detachRequested returns whether another node asked for a volume
+func (driver *linodeVolumeDriver) detachRequested(volumeID int) bool {
+	api, err := driver.linodeAPI()
+	if err != nil {
+		return false
+	}
+
+	linVol, err := api.GetVolume(context.Background(), volumeID)
+	if err != nil {
+		log.Warnf("Failed to check volume %d for detach requests: %s", volumeID, err)
+		return false
+	}
+	return hasTag(linVol.Tags, detachRequestTag)
+}
+
+// requestDetach asks the node holding an idle volume to detach it and waits
+// for it to do so
+func (driver *linodeVolumeDriver) requestDetach(api *linodego.Client, linVol *linodego.Volume) error {
+	log.Infof("Requesting volume %s from linode %d", linVol.Label, *linVol.LinodeID)
+
+	if err := driver.addVolumeTags(api, linVol, detachRequestTag); err != nil {
+		return fmt.Errorf("failed to request detach of volume %s: %s", linVol.Label, err)
+	}
+
+	err := waitForLinodeVolumeDetachment(*api, linVol.ID, int(detachRequestTimeout.Seconds()))
+	if err != nil {
+		err = fmt.Errorf("volume is currently attached to linode %d, which did not release it", *linVol.LinodeID)
+	}
+
+	// The request is over either way. Once released, the volume is no
+	// longer idle even if the holder failed to clear its mark.
+	remove := []string{detachRequestTag}
+	if err == nil {
+		remove = append(remove, detachIdleTag)
+	}
+	if tagErr := driver.removeVolumeTags(api, linVol, remove...); tagErr != nil {
+		log.Warnf("Failed to clear detach request of volume %s: %s", linVol.Label, tagErr)
+	}
+
+	return err
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/linode/linodego/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	linodeSCSIVendor = "Linode"
+	linodeSCSIModel  = "Volume"
+)
+
+// linodeSCSISerialPrefixes precede the volume label in the SCSI identifiers
+// of Linode volumes, e.g. "0Linode_Volume_my-volume"
+var linodeSCSISerialPrefixes = []string{"scsi-0Linode_Volume_", "0Linode_Volume_", "Linode_Volume_"}
+
+// resolveVolumeDevice resolves the by-id link of a Linode volume to its
+// block device and checks that the SCSI identity of that device belongs to
+// the volume. The returned path should be used for any further operation
+// so that a link swapped in the meantime is not followed again. identified
+// is false when the device exposes no identifier to check.
+func resolveVolumeDevice(linVol *linodego.Volume) (device string, identified bool, err error) {
+	device, err = filepath.EvalSymlinks(linVol.FilesystemPath)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to resolve device %s: %s", linVol.FilesystemPath, err)
+	}
+
+	sysDevice := filepath.Join("/sys/class/block", filepath.Base(device), "device")
+
+	if vendor, ok := readTrimmedFile(filepath.Join(sysDevice, "vendor")); ok && vendor != linodeSCSIVendor {
+		return "", false, fmt.Errorf("device %s has SCSI vendor %q, expected %q", device, vendor, linodeSCSIVendor)
+	}
+	if model, ok := readTrimmedFile(filepath.Join(sysDevice, "model")); ok && model != linodeSCSIModel {
+		return "", false, fmt.Errorf("device %s has SCSI model %q, expected %q", device, model, linodeSCSIModel)
+	}
+
+	ids := scsiIdentifiers(sysDevice)
+	if len(ids) == 0 {
+		log.Warnf("No SCSI serial or WWN found for device %s, skipping identity check", device)
+		return device, false, nil
+	}
+
+	for _, id := range ids {
+		if scsiIdentifierMatches(id, linVol.Label) {
+			log.Debugf("Device %s matches volume %s (%s)", device, linVol.Label, id)
+			return device, true, nil
+		}
+	}
+
+	return "", false, fmt.Errorf("device %s does not belong to volume %s (identifiers: %s)",
+		device, linVol.Label, strings.Join(ids, ", "))
+}
+
+// scsiIdentifiers returns the WWN and unit serial number of a SCSI device
+func scsiIdentifiers(sysDevice string) []string {
+	var ids []string
+
+	if wwid, ok := readTrimmedFile(filepath.Join(sysDevice, "wwid")); ok && wwid != "" {
+		ids = append(ids, wwid)
+	}
+
+	// VPD page 0x80 is a 4 byte header followed by the serial number
+	if page, err := os.ReadFile(filepath.Join(sysDevice, "vpd_pg80")); err == nil && len(page) > 4 {
+		if serial := strings.TrimSpace(string(page[4:])); serial != "" {
+			ids = append(ids, serial)
+		}
+	}
+
+	return ids
+}
+
+// scsiIdentifierMatches reports whether a SCSI identifier names the volume
+// label. Linode volumes carry their label as the last field of the serial
+// and WWN, either alone ("t10.Linode  Volume  my-volume") or after a known
+// prefix ("0Linode_Volume_my-volume"). The whole field must match, as labels
+// may contain "_" themselves.
+func scsiIdentifierMatches(id, label string) bool {
+	fields := strings.Fields(id)
+	if len(fields) == 0 {
+		return false
+	}
+
+	last := fields[len(fields)-1]
+	if last == label {
+		return true
+	}
+	for _, prefix := range linodeSCSISerialPrefixes {
+		if last == prefix+label {
+			return true
+		}
+	}
+	return false
+}
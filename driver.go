@@ -3,51 +3,143 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
-	metadata "github.com/linode/go-metadata"
 	"github.com/linode/linodego/v2"
 	log "github.com/sirupsen/logrus"
 )
 
 type linodeVolumeDriver struct {
-	instanceID   int
-	region       string
+	identity     atomic.Pointer[instanceIdentity]
 	linodeLabel  string
 	linodeToken  string
 	mountRoot    string
+	stateDir     string
 	mutex        *sync.Mutex
+	apiMutex     *sync.Mutex
 	linodeAPIPtr *linodego.Client
+	events       *eventWatcher
+	attaches     *attachScheduler
+	journal      *journal
+
+	lifecycleMutex *sync.Mutex
+	inflight       *sync.WaitGroup
+	stopping       bool
+	cordoned       bool
+	identityErr    error
+
+	detachMutex     *sync.Mutex
+	pendingDetaches map[int]*pendingDetach
+
+	slotsMutex          *sync.Mutex
+	instanceVolumeSlots int
+	mounting            map[int]int
+	attachSlotMutex     *sync.Mutex
+	slotReservations    map[int]struct{}
 }
 
+var errVolumeNotFound = errors.New("volume not found")
+
 const (
 	fsTagPrefix = "docker-volume-filesystem-"
+
+	// defaultFilesystem is used for volumes without a filesystem option
+	defaultFilesystem = "ext4"
+
+	// fsUUIDTagPrefix records the filesystem UUID without dashes, as volume
+	// tags are limited to 50 characters
+	fsUUIDTagPrefix = "docker-fsuuid-"
+
+	// unformattedTag marks volumes created by the plugin that were never
+	// formatted, the only ones that are formatted without being asked to
+	unformattedTag = "docker-volume-unformatted"
+
+	// allowFormatTag allows a volume that isn't blank to be formatted once
+	allowFormatTag = "docker-volume-allow-format"
+
+	// formattingTag is set while a volume is being formatted, so that an
+	// interrupted format is never mistaken for a filesystem
+	formattingTag = "docker-volume-formatting"
+
+	// deleteOnRemoveTag deletes the volume when it is removed from Docker
+	deleteOnRemoveTag = "docker-volume-delete-on-remove"
+
+	// blankProbeSize is the number of leading bytes that must be zero for a
+	// device to be considered blank
+	blankProbeSize = 1024 * 1024
 )
 
 // Constructor
-func newLinodeVolumeDriver(linodeLabel, linodeToken, mountRoot string) linodeVolumeDriver {
-	driver := linodeVolumeDriver{
+func newLinodeVolumeDriver(linodeLabel, linodeToken, mountRoot, stateDir string) *linodeVolumeDriver {
+	driver := &linodeVolumeDriver{
 		linodeToken: linodeToken,
 		linodeLabel: linodeLabel,
 		mountRoot:   mountRoot,
+		stateDir:    stateDir,
 		mutex:       &sync.Mutex{},
+		apiMutex:    &sync.Mutex{},
+
+		lifecycleMutex: &sync.Mutex{},
+		inflight:       &sync.WaitGroup{},
+
+		detachMutex:     &sync.Mutex{},
+		pendingDetaches: make(map[int]*pendingDetach),
+
+		slotsMutex:       &sync.Mutex{},
+		mounting:         make(map[int]int),
+		attachSlotMutex:  &sync.Mutex{},
+		slotReservations: make(map[int]struct{}),
 	}
-	if _, err := driver.linodeAPI(); err != nil {
+	driver.events = newEventWatcher(func() (eventSource, error) {
+		api, err := driver.linodeAPI()
+		if err != nil {
+			return nil, err
+		}
+		return api, nil
+	})
+	driver.attaches = newAttachScheduler(config().AttachConcurrency)
+	api, err := driver.linodeAPI()
+	if err != nil {
+		// a token lacking scopes is a common reason
+		if api, apiErr := setupLinodeAPI(linodeToken); apiErr == nil {
+			driver.preflightToken(api, false)
+		}
 		log.Fatalf("Could not initialize Linode API: %s", err)
 	}
+	if err := driver.preflightToken(api, config().TokenPreflightStrict); err != nil {
+		log.Fatalf("Linode token preflight failed: %s", err)
+	}
+
+	j, err := newJournal(path.Join(stateDir, "journal"))
+	if err != nil {
+		log.Fatalf("Could not initialize operation journal: %s", err)
+	}
+	driver.journal = j
+	driver.recoverJournal()
+	driver.loadCordoned()
+	driver.resumeIdleDetaches(api)
+
+	if interval := config().IdentityVerifyInterval; interval > 0 {
+		go driver.verifyIdentityPeriodically(time.Duration(interval) * time.Second)
+	}
 
 	return driver
 }
 
 func (driver *linodeVolumeDriver) linodeAPI() (*linodego.Client, error) {
+	driver.apiMutex.Lock()
+	defer driver.apiMutex.Unlock()
+
 	if driver.linodeToken == "" {
 		return nil, fmt.Errorf("Linode Token required.  Set the token by calling \"docker plugin set <plugin-name> linode-token=<linode token>\"")
 	}
@@ -62,7 +154,7 @@ func (driver *linodeVolumeDriver) linodeAPI() (*linodego.Client, error) {
 	}
 	driver.linodeAPIPtr = api
 
-	if driver.instanceID == 0 {
+	if driver.instanceID() == 0 {
 		if err := driver.determineLinodeID(); err != nil {
 			driver.linodeAPIPtr = nil
 			return nil, err
@@ -73,153 +165,41 @@ func (driver *linodeVolumeDriver) linodeAPI() (*linodego.Client, error) {
 }
 
 func setupLinodeAPI(token string) (*linodego.Client, error) {
-	api, err := linodego.NewClient(nil)
+	cfg := config()
+	hc, err := newAPIHTTPClient(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Linode API client: %w", err)
-	}
-
-	ua := fmt.Sprintf("docker-volume-linode/%s linodego/%s", VERSION, linodego.Version)
-	api.SetUserAgent(ua)
-	api.SetToken(token)
-
-	return &api, nil
-}
-
-func metadataServicesAvailable() bool {
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:80", metadata.APIHost), 2*time.Second)
-	if err != nil {
-		return false
-	}
-
-	conn.Close()
-	return true
-}
-
-func (driver *linodeVolumeDriver) determineLinodeID() error {
-	if metadataServicesAvailable() {
-		err := driver.determineLinodeIDFromMetadata()
-		if err != nil {
-			log.Error(
-				"Failed to get linode info from Linode metadata service. " +
-					"Other methods will be used.",
-			)
-		}
-	}
-
-	if driver.linodeLabel == "" {
-		// If the label isn't defined, we should determine the IP through the network interface
-		log.Info("Using network interface to determine Linode ID")
-
-		if err := driver.determineLinodeIDFromNetworking(); err != nil {
-			return fmt.Errorf("Failed to determine Linode ID from networking: %s\n"+
-				"If this error continues to occur or if you are using a custom network configuration, "+
-				"consider using the `linode-label` flag.", err)
-		}
-
-		return nil
-	}
-
-	return driver.determineLinodeIDFromLabel()
-}
-
-func (driver *linodeVolumeDriver) determineLinodeIDFromMetadata() error {
-	client, err := metadata.NewClient(context.Background())
-	if err != nil {
-		return err
-	}
-
-	instanceInfo, err := client.GetInstance(context.Background())
-	if err != nil {
-		return err
-	}
-
-	driver.instanceID = instanceInfo.ID
-	driver.region = instanceInfo.Region
-	driver.linodeLabel = instanceInfo.Label
-
-	return nil
-}
-
-func (driver *linodeVolumeDriver) determineLinodeIDFromLabel() error {
-	jsonFilter, _ := json.Marshal(map[string]string{"label": driver.linodeLabel})
-	listOpts := linodego.NewListOptions(0, string(jsonFilter))
-	linodes, lErr := driver.linodeAPIPtr.ListInstances(context.Background(), listOpts)
-
-	if lErr != nil {
-		return fmt.Errorf("Could not determine Linode instance ID from Linode label %s due to error: %s", driver.linodeLabel, lErr)
-	} else if len(linodes) != 1 {
-		return fmt.Errorf("Could not determine Linode instance ID from Linode label %s", driver.linodeLabel)
-	}
-
-	driver.instanceID = linodes[0].ID
-	if driver.region == "" {
-		driver.region = linodes[0].Region
-	}
-	return nil
-}
-
-func (driver *linodeVolumeDriver) resolveMachineLinkLocal() (string, error) {
-	// We only want to filter on eth0 for Link Local.
-	iface, err := net.InterfaceByName("eth0")
-	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	addrs, err := iface.Addrs()
+	api, err := linodego.NewClient(hc)
 	if err != nil {
-		return "", err
-	}
-
-	for _, addr := range addrs {
-		if ifa, ok := addr.(*net.IPNet); ok {
-			if ifa.IP.To4() != nil {
-				continue
-			}
-
-			if !ifa.IP.IsLinkLocalUnicast() {
-				continue
-			}
-			return strings.Split(addr.String(), "/")[0], nil
-		}
+		return nil, fmt.Errorf("failed to create Linode API client: %w", err)
 	}
 
-	return "", fmt.Errorf("no link local ipv6 address found")
-}
-
-func (driver *linodeVolumeDriver) determineLinodeIDFromNetworking() error {
-	linkLocal, err := driver.resolveMachineLinkLocal()
-	if err != nil {
-		return fmt.Errorf("failed to determine linode id from networking: %s", err)
+	if cfg.APIURL != "" {
+		api.SetBaseURL(cfg.APIURL)
 	}
-
-	instances, err := driver.linodeAPIPtr.ListInstances(context.Background(), nil)
-	if err != nil {
-		return fmt.Errorf("failed to list instances: %s", err)
+	if cfg.APIVersion != "" {
+		api.SetAPIVersion(cfg.APIVersion)
 	}
 
-	for _, instance := range instances {
-		ips, err := driver.linodeAPIPtr.GetInstanceIPAddresses(context.Background(), instance.ID)
-		if err != nil {
-			return fmt.Errorf("failed to get ip addresses for instance %d: %s", instance.ID, err)
-		}
-
-		if ips.IPv6.LinkLocal == nil || ips.IPv6.LinkLocal.Address != linkLocal {
-			continue
-		}
+	ua := fmt.Sprintf("docker-volume-linode/%s linodego/%s", VERSION, linodego.Version)
+	api.SetUserAgent(ua)
+	api.SetToken(token)
 
-		driver.instanceID = instance.ID
-		driver.region = instance.Region
-		return nil
-	}
+	// debug output goes through the redacting log formatter
+	api.SetLogger(log.StandardLogger())
 
-	return fmt.Errorf("instance with link local address %s not found", linkLocal)
+	return &api, nil
 }
 
 // Get implementation
 func (driver *linodeVolumeDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
 	log.Infof("Get(%s)", req.Name)
 	linVol, err := driver.findVolumeByLabel(req.Name)
-	if err != nil {
+	if errors.Is(err, errVolumeNotManaged) {
+		return nil, fmt.Errorf("Instance %d Volume with name %s: %w", driver.instanceID(), req.Name, errVolumeNotFound)
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -253,7 +233,7 @@ func (driver *linodeVolumeDriver) List() (*volume.ListResponse, error) {
 	var volumes []*volume.Volume
 
 	// filters
-	if jsonFilter, err = json.Marshal(map[string]string{"region": driver.region}); err != nil {
+	if jsonFilter, err = json.Marshal(map[string]string{"region": driver.region()}); err != nil {
 		return nil, err
 	}
 	listOpts := linodego.NewListOptions(0, string(jsonFilter))
@@ -264,7 +244,11 @@ func (driver *linodeVolumeDriver) List() (*volume.ListResponse, error) {
 		return nil, err
 	}
 	log.Debugf("Got %d volume count from api", len(linVols))
+	guard := driver.volumeGuard()
 	for _, linVol := range linVols {
+		if !guard.allows(&linVol) {
+			continue
+		}
 		mp := driver.labelToMountPoint(linVol.Label)
 		vol := linodeVolumeToDockerVolume(linVol, mp)
 		log.Debugf("Volume: %+v", vol)
@@ -278,6 +262,12 @@ func (driver *linodeVolumeDriver) List() (*volume.ListResponse, error) {
 func (driver *linodeVolumeDriver) Create(req *volume.CreateRequest) error {
 	log.Infof("Create(%s)", req.Name)
 
+	done, err := driver.track()
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	api, err := driver.linodeAPI()
 	if err != nil {
 		return err
@@ -286,6 +276,18 @@ func (driver *linodeVolumeDriver) Create(req *volume.CreateRequest) error {
 	driver.mutex.Lock()
 	defer driver.mutex.Unlock()
 
+	entry := driver.journal.begin(opCreate, req.Name)
+	defer driver.journal.finish(entry)
+
+	cfg := config()
+	guard := driver.volumeGuard()
+	if err := guard.checkLabel(volumeLabel(req.Name)); err != nil {
+		return fmt.Errorf("Create(%s) refused: %s", req.Name, err)
+	}
+	if label := volumeLabel(req.Name); len(label) > maxLabelLength {
+		return fmt.Errorf("Create(%s) refused: label %s is longer than %d characters", req.Name, label, maxLabelLength)
+	}
+
 	var size int
 
 	if sizeOpt, ok := req.Options["size"]; ok {
@@ -297,45 +299,182 @@ func (driver *linodeVolumeDriver) Create(req *volume.CreateRequest) error {
 	}
 
 	createOpts := linodego.VolumeCreateOptions{
-		Label:  req.Name,
-		Region: driver.region,
+		Label:  volumeLabel(req.Name),
+		Region: driver.region(),
 		Size:   size,
+		Tags:   []string{unformattedTag},
+	}
+	if guard.requiredTag != "" {
+		createOpts.Tags = append(createOpts.Tags, guard.requiredTag)
+	}
+	if size == 0 {
+		createOpts.Size = cfg.DefaultSize
 	}
 
 	if fsOpt, ok := req.Options["filesystem"]; ok {
 		createOpts.Tags = append(createOpts.Tags, fsTagPrefix+fsOpt)
+	} else {
+		createOpts.Tags = append(createOpts.Tags, fsTagPrefix+cfg.DefaultFilesystem)
 	}
 
+	deleteOnRemove := cfg.DefaultDeleteOnRemove
 	if deleteOpt, ok := req.Options["delete-on-remove"]; ok {
 		b, err := strconv.ParseBool(deleteOpt)
 		if err != nil {
 			return fmt.Errorf("Invalid delete-on-remove argument")
 		}
+		deleteOnRemove = b
+	}
+	if deleteOnRemove {
+		createOpts.Tags = append(createOpts.Tags, deleteOnRemoveTag)
+	}
+
+	if delayOpt, ok := req.Options["detach-delay"]; ok {
+		seconds, err := strconv.Atoi(delayOpt)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("Invalid detach-delay argument")
+		}
+		createOpts.Tags = append(createOpts.Tags, detachDelayTagPrefix+strconv.Itoa(seconds))
+	}
+
+	if formatOpt, ok := req.Options["allow-format"]; ok {
+		b, err := strconv.ParseBool(formatOpt)
+		if err != nil {
+			return fmt.Errorf("Invalid allow-format argument")
+		}
 		if b {
-			createOpts.Tags = append(createOpts.Tags, "docker-volume-delete-on-remove")
+			createOpts.Tags = append(createOpts.Tags, allowFormatTag)
 		}
 	}
 
+	// A retried Create finds the volume of the first attempt
+	existing, err := driver.findVolumeByLabel(req.Name)
+	if err == nil {
+		return driver.adoptVolume(api, existing, size, req.Options)
+	} else if !errors.Is(err, errVolumeNotFound) {
+		return err
+	}
+
+	mark, markErr := driver.events.mark()
+	if markErr != nil {
+		log.Warnf("Failed to read Linode events, falling back to polling: %s", markErr)
+	}
+
+	rb := newRollback(fmt.Sprintf("Create(%s)", req.Name))
+	defer rb.run()
+
 	volume, err := api.CreateVolume(context.Background(), createOpts)
 	if err != nil {
 		return fmt.Errorf("Create(%s) Failed: %s", req.Name, err)
 	}
+	rb.add(fmt.Sprintf("delete volume %d", volume.ID), func() error {
+		return api.DeleteVolume(context.Background(), volume.ID)
+	})
+	driver.journal.setVolumeID(entry, volume.ID)
+	driver.journal.step(entry, stepCreated)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
 	defer cancel()
 
-	_, err = api.WaitForVolumeStatus(ctx, volume.ID, linodego.VolumeActive)
+	if markErr == nil {
+		err = driver.events.waitForVolumeEvent(ctx, mark, volume.ID, linodego.ActionVolumeCreate)
+	} else {
+		_, err = api.WaitForVolumeStatus(ctx, volume.ID, linodego.VolumeActive)
+	}
 	if err != nil {
 		return fmt.Errorf(
 			"Failed to wait for volume %d to be active: %w", volume.ID, err,
 		)
 	}
 
+	rb.commit()
+	return nil
+}
+
+// adoptVolume takes over an existing volume for Create if its size and
+// filesystem match the requested ones, and applies the other options given
+// to Create to it
+func (driver *linodeVolumeDriver) adoptVolume(api *linodego.Client, linVol *linodego.Volume, size int, options map[string]string) error {
+	filesystem := options["filesystem"]
+	if size != 0 && size != linVol.Size {
+		return fmt.Errorf("Create(%s) Failed: volume already exists with size %dGB, requested %dGB",
+			linVol.Label, linVol.Size, size)
+	}
+
+	if filesystem != "" && filesystem != volumeFilesystem(linVol) {
+		return fmt.Errorf("Create(%s) Failed: volume already exists with filesystem %s, requested %s",
+			linVol.Label, volumeFilesystem(linVol), filesystem)
+	}
+
+	log.Infof("Create(%s): adopting existing volume %d", linVol.Label, linVol.ID)
+
+	if tags := adoptedVolumeTags(linVol.Tags, options); !slices.Equal(tags, linVol.Tags) {
+		if err := driver.setVolumeTags(api, linVol, tags); err != nil {
+			return fmt.Errorf("Create(%s) Failed: failed to update tags: %s", linVol.Label, err)
+		}
+	}
+
+	if linVol.Status == linodego.VolumeActive {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 600*time.Second)
+	defer cancel()
+
+	if _, err := api.WaitForVolumeStatus(ctx, linVol.ID, linodego.VolumeActive); err != nil {
+		return fmt.Errorf(
+			"Failed to wait for volume %d to be active: %w", linVol.ID, err,
+		)
+	}
 	return nil
 }
 
+// adoptedVolumeTags returns tags updated with the allow-format, detach-delay
+// and delete-on-remove options explicitly given to Create. The options were
+// validated by Create already.
+func adoptedVolumeTags(tags []string, options map[string]string) []string {
+	delayOpt, setDelay := options["detach-delay"]
+	deleteOpt, setDelete := options["delete-on-remove"]
+
+	var updated []string
+	for _, tag := range tags {
+		if (setDelay && strings.HasPrefix(tag, detachDelayTagPrefix)) || (setDelete && tag == deleteOnRemoveTag) {
+			continue
+		}
+		updated = append(updated, tag)
+	}
+
+	if setDelay {
+		seconds, _ := strconv.Atoi(delayOpt)
+		updated = append(updated, detachDelayTagPrefix+strconv.Itoa(seconds))
+	}
+	if b, _ := strconv.ParseBool(deleteOpt); setDelete && b {
+		updated = append(updated, deleteOnRemoveTag)
+	}
+	if b, _ := strconv.ParseBool(options["allow-format"]); b && !hasTag(updated, allowFormatTag) {
+		updated = append(updated, allowFormatTag)
+	}
+	return updated
+}
+
+// volumeFilesystem returns the filesystem a volume is formatted with
+func volumeFilesystem(linVol *linodego.Volume) string {
+	for _, tag := range linVol.Tags {
+		if strings.HasPrefix(tag, fsTagPrefix) {
+			return tag[len(fsTagPrefix):]
+		}
+	}
+	return defaultFilesystem
+}
+
 // Remove implementation
 func (driver *linodeVolumeDriver) Remove(req *volume.RemoveRequest) error {
+	done, err := driver.track()
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	driver.mutex.Lock()
 	defer driver.mutex.Unlock()
 
@@ -347,19 +486,60 @@ func (driver *linodeVolumeDriver) Remove(req *volume.RemoveRequest) error {
 
 	//
 	linVol, err := driver.findVolumeByLabel(req.Name)
+	if errors.Is(err, errVolumeNotFound) {
+		log.Infof("Remove(%s): volume does not exist anymore", req.Name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Refuse to pull the volume from under a container on another node
+	if linVol.LinodeID != nil && *linVol.LinodeID != driver.instanceID() {
+		if !config().ForceRemove {
+			return fmt.Errorf("volume %s is in use by linode %s (%d), refusing to remove it; "+
+				"set force-remove=true to override", req.Name, driver.instanceLabel(api, *linVol.LinodeID), *linVol.LinodeID)
+		}
+		log.Warnf("Forcibly removing volume %s attached to linode %d", req.Name, *linVol.LinodeID)
+	}
+
+	// ... or on this one
+	mp := driver.labelToMountPoint(linVol.Label)
+	mounted, err := isMounted(mp)
 	if err != nil {
 		return err
 	}
+	if mounted && !config().ForceRemove {
+		return fmt.Errorf("volume %s is mounted at %s, refusing to remove it; "+
+			"set force-remove=true to override", req.Name, mp)
+	}
+
+	entry := driver.journal.begin(opRemove, req.Name)
+	defer driver.journal.finish(entry)
+	driver.journal.setVolumeID(entry, linVol.ID)
+
+	driver.cancelDetach(linVol.ID)
+
+	if mounted {
+		log.Warnf("Forcibly removing volume %s mounted at %s", req.Name, mp)
+		cfg := config()
+		if err := unmountWithPolicy(mp, cfg.BusyUnmountPolicy, cfg.BusyUnmountRetries); err != nil {
+			return fmt.Errorf("Unable to Unmount(%s): %s", req.Name, err)
+		}
+		driver.journal.step(entry, stepUnmounted)
+	}
 
 	// Send detach request
-	if err := detachAndWait(api, linVol.ID); err != nil {
-		return err
+	if linVol.LinodeID != nil {
+		if err := driver.detachAndWait(api, linVol.ID); err != nil {
+			return err
+		}
+		driver.journal.step(entry, stepDetached)
 	}
 
 	// Optionally send Delete request
 	for _, t := range linVol.Tags {
-		if t == "docker-volume-delete-on-remove" {
-			if err := api.DeleteVolume(context.Background(), linVol.ID); err != nil {
+		if t == deleteOnRemoveTag {
+			if err := api.DeleteVolume(context.Background(), linVol.ID); err != nil && !linodego.IsNotFound(err) {
 				return err
 			}
 			break
@@ -373,6 +553,19 @@ func (driver *linodeVolumeDriver) Remove(req *volume.RemoveRequest) error {
 func (driver *linodeVolumeDriver) Mount(req *volume.MountRequest) (*volume.MountResponse, error) {
 	log.Infof("Called Mount %s", req.Name)
 
+	if driver.isCordoned() {
+		return nil, fmt.Errorf("Mount(%s) refused: node is cordoned", req.Name)
+	}
+	if err := driver.identityError(); err != nil {
+		return nil, fmt.Errorf("Mount(%s) refused: %s", req.Name, err)
+	}
+
+	done, err := driver.track()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	api, err := driver.linodeAPI()
 	if err != nil {
 		return nil, err
@@ -388,8 +581,39 @@ func (driver *linodeVolumeDriver) Mount(req *volume.MountRequest) (*volume.Mount
 		return nil, err
 	}
 
+	entry := driver.journal.begin(opMount, req.Name)
+	defer driver.journal.finish(entry)
+	driver.journal.setVolumeID(entry, linVol.ID)
+
+	// Keep the volume from being evicted before it is mounted
+	driver.beginMount(linVol.ID)
+	defer driver.endMount(linVol.ID)
+
+	rb := newRollback(fmt.Sprintf("Mount(%s)", req.Name))
+	defer rb.run()
+
+	// Take over the volume if it is still attached from an earlier mount,
+	// it is left idle again if the mount fails
+	if driver.cancelDetach(linVol.ID) {
+		log.Infof("Volume %s is still attached, reusing it", req.Name)
+		rb.add(fmt.Sprintf("reschedule detach of volume %d", linVol.ID), func() error {
+			driver.scheduleDetach(linVol, driver.volumeDetachDelay(linVol))
+			return nil
+		})
+	}
+
 	// Ensure the volume is not currently mounted
-	if err := driver.ensureVolumeAttached(linVol.ID); err != nil {
+	// An attach that timed out may still complete, so it is undone as well
+	attached, err := driver.attaches.attach(linVol.ID, linVol.Label, func() (bool, error) {
+		return driver.ensureVolumeAttached(linVol.ID)
+	})
+	if attached {
+		rb.add(fmt.Sprintf("detach volume %d", linVol.ID), func() error {
+			return driver.detachAndWait(api, linVol.ID)
+		})
+		driver.journal.step(entry, stepAttached)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("failed to attach volume: %s", err)
 	}
 
@@ -398,19 +622,52 @@ func (driver *linodeVolumeDriver) Mount(req *volume.MountRequest) (*volume.Mount
 		return nil, err
 	}
 
+	// Make sure the link points at this volume before touching the device
+	device, identified, err := resolveVolumeDevice(linVol)
+	if err != nil {
+		return nil, err
+	}
+
 	// Format block device if no FS found
-	if GetFSType(linVol.FilesystemPath) == "" {
-		log.Infof("Formatting device:%s;", linVol.FilesystemPath)
-		filesystem := "ext4"
-		for _, tag := range linVol.Tags {
-			if strings.HasPrefix(tag, fsTagPrefix) {
-				filesystem = tag[len(fsTagPrefix):]
-				break
+	fsType := GetFSType(device)
+	if hasTag(linVol.Tags, formattingTag) {
+		log.Warnf("Previous format of volume %s was interrupted, ignoring filesystem %q", linVol.Label, fsType)
+		fsType = ""
+	}
+	if fsType == "" {
+		// Never format a device that could not be matched to the volume
+		if !identified {
+			return nil, fmt.Errorf("refusing to format volume %s: device %s has no SCSI serial or WWN to check it belongs to the volume",
+				linVol.Label, device)
+		}
+		if err := checkFormatAllowed(linVol, device); err != nil {
+			return nil, err
+		}
+
+		// Mark the volume first so a crash mid-format is detected later
+		if !hasTag(linVol.Tags, formattingTag) {
+			if err := driver.addVolumeTags(api, linVol, formattingTag); err != nil {
+				return nil, fmt.Errorf("failed to mark volume %s as formatting: %s", linVol.Label, err)
 			}
 		}
-		if err := Format(linVol.FilesystemPath, filesystem); err != nil {
+		driver.journal.step(entry, stepFormatting)
+
+		log.Infof("Formatting device:%s;", device)
+		fsType = volumeFilesystem(linVol)
+		if err := Format(device, fsType); err != nil {
 			return nil, err
 		}
+
+		// The format markers only ever apply once
+		if err := driver.removeVolumeTags(api, linVol, unformattedTag, allowFormatTag, formattingTag); err != nil {
+			return nil, err
+		}
+		driver.journal.step(entry, stepFormatted)
+	}
+
+	// Refuse to mount a filesystem other than the one recorded for the volume
+	if err := driver.verifyFilesystemUUID(api, linVol, device); err != nil {
+		return nil, err
 	}
 
 	// Create mount point using label (if not exists)
@@ -420,57 +677,240 @@ func (driver *linodeVolumeDriver) Mount(req *volume.MountRequest) (*volume.Mount
 		if err = os.MkdirAll(mp, 0o755); err != nil {
 			return nil, fmt.Errorf("Error creating mountpoint directory(%s): %s", mp, err)
 		}
+		rb.add(fmt.Sprintf("remove mountpoint directory %s", mp), func() error {
+			return os.Remove(mp)
+		})
+		driver.journal.step(entry, stepMkdir)
 	}
 
-	if err := Mount(linVol.FilesystemPath, mp); err != nil {
-		return nil, fmt.Errorf("Error mounting volume(%s) to directory(%s): %s", linVol.FilesystemPath, mp, err)
+	mounted, err := Mount(device, mp, fsType)
+	if err != nil {
+		return nil, fmt.Errorf("Error mounting volume(%s) to directory(%s): %s", device, mp, err)
+	}
+	// an existing mount is not ours to undo on recovery
+	if mounted {
+		driver.journal.step(entry, stepMounted)
 	}
 
+	rb.commit()
 	log.Infof("Mount Call End: %s", req.Name)
 	return &volume.MountResponse{Mountpoint: mp}, nil
 }
 
+// verifyFilesystemUUID checks the filesystem UUID of device against the one
+// recorded in the volume tags. The UUID is recorded when the volume has none.
+func (driver *linodeVolumeDriver) verifyFilesystemUUID(api *linodego.Client, linVol *linodego.Volume, device string) error {
+	uuid := strings.ReplaceAll(strings.ToLower(GetFSUUID(device)), "-", "")
+	if uuid == "" {
+		return fmt.Errorf("failed to read filesystem UUID of device %s", device)
+	}
+
+	for _, tag := range linVol.Tags {
+		if !strings.HasPrefix(tag, fsUUIDTagPrefix) {
+			continue
+		}
+
+		if expected := tag[len(fsUUIDTagPrefix):]; expected != uuid {
+			return fmt.Errorf("device %s has filesystem UUID %s, but volume %s was formatted with %s",
+				device, uuid, linVol.Label, expected)
+		}
+		return nil
+	}
+
+	log.Infof("Recording filesystem UUID %s for volume %s", uuid, linVol.Label)
+	if err := driver.addVolumeTags(api, linVol, fsUUIDTagPrefix+uuid); err != nil {
+		return fmt.Errorf("failed to record filesystem UUID of volume %s: %s", linVol.Label, err)
+	}
+
+	return nil
+}
+
+// checkFormatAllowed refuses to format a device unless it is blank and the
+// volume was never formatted by the plugin, or formatting was explicitly
+// allowed with the allow-format option.
+func checkFormatAllowed(linVol *linodego.Volume, device string) error {
+	if hasTag(linVol.Tags, formattingTag) {
+		return nil
+	}
+
+	if hasTag(linVol.Tags, allowFormatTag) {
+		log.Warnf("Formatting of volume %s explicitly allowed", linVol.Label)
+		return nil
+	}
+
+	if !hasTag(linVol.Tags, unformattedTag) {
+		return fmt.Errorf("refusing to format volume %s: no filesystem found, but the volume was not created "+
+			"by this plugin or was formatted before; tag the volume with %s to format it", linVol.Label, allowFormatTag)
+	}
+
+	signatures, err := GetSignatures(device)
+	if err != nil {
+		return fmt.Errorf("refusing to format volume %s: %s", linVol.Label, err)
+	}
+	if len(signatures) > 0 {
+		return fmt.Errorf("refusing to format volume %s: device %s contains signatures: %s",
+			linVol.Label, device, strings.Join(signatures, ", "))
+	}
+
+	zeroed, err := IsZeroed(device, blankProbeSize)
+	if err != nil {
+		return fmt.Errorf("refusing to format volume %s: %s", linVol.Label, err)
+	}
+	if !zeroed {
+		return fmt.Errorf("refusing to format volume %s: device %s is not blank", linVol.Label, device)
+	}
+
+	return nil
+}
+
+// setVolumeTags replaces the tags of a volume
+func (driver *linodeVolumeDriver) setVolumeTags(api *linodego.Client, linVol *linodego.Volume, tags []string) error {
+	updated, err := api.UpdateVolume(context.Background(), linVol.ID, linodego.VolumeUpdateOptions{Tags: &tags})
+	if err != nil {
+		return err
+	}
+	linVol.Tags = updated.Tags
+	return nil
+}
+
+// updateVolumeTags adds and removes the given tags of a volume. The tags are
+// read again first, so that tags another node set in the meantime are kept.
+func (driver *linodeVolumeDriver) updateVolumeTags(api *linodego.Client, linVol *linodego.Volume, add, remove []string) error {
+	current, err := api.GetVolume(context.Background(), linVol.ID)
+	if err != nil {
+		return fmt.Errorf("failed to read tags of volume %s: %s", linVol.Label, err)
+	}
+
+	tags := []string{}
+	for _, tag := range current.Tags {
+		if !hasTag(remove, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	for _, tag := range add {
+		if !hasTag(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	if slices.Equal(tags, current.Tags) {
+		linVol.Tags = current.Tags
+		return nil
+	}
+
+	if err := driver.setVolumeTags(api, linVol, tags); err != nil {
+		return fmt.Errorf("failed to update tags of volume %s: %s", linVol.Label, err)
+	}
+	return nil
+}
+
+// addVolumeTags adds the given tags to a volume, if missing
+func (driver *linodeVolumeDriver) addVolumeTags(api *linodego.Client, linVol *linodego.Volume, add ...string) error {
+	return driver.updateVolumeTags(api, linVol, add, nil)
+}
+
+// removeVolumeTags removes the given tags from a volume, if present
+func (driver *linodeVolumeDriver) removeVolumeTags(api *linodego.Client, linVol *linodego.Volume, remove ...string) error {
+	return driver.updateVolumeTags(api, linVol, nil, remove)
+}
+
 // Path implementation
 func (driver *linodeVolumeDriver) Path(req *volume.PathRequest) (*volume.PathResponse, error) {
 	log.Infof("Path(%s)", req.Name)
 
 	linVol, err := driver.findVolumeByLabel(req.Name)
-	if err != nil {
+	if errors.Is(err, errVolumeNotManaged) {
+		return nil, fmt.Errorf("Instance %d Volume with name %s: %w", driver.instanceID(), req.Name, errVolumeNotFound)
+	} else if err != nil {
 		return nil, err
 	}
 
+	// Only report a mountpoint while the volume is actually mounted
 	mp := driver.labelToMountPoint(linVol.Label)
+	mounted, err := isMounted(mp)
+	if err != nil {
+		return nil, err
+	}
+	if !mounted {
+		mp = ""
+	}
+
 	log.Infof("Path(): %s", mp)
 	return &volume.PathResponse{Mountpoint: mp}, nil
 }
 
 // Unmount implementation
 func (driver *linodeVolumeDriver) Unmount(req *volume.UnmountRequest) error {
+	done, err := driver.track()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return driver.unmountVolume(req.Name, false)
+}
+
+// unmountVolume unmounts a volume and detaches it, either right away or
+// after its detach delay
+func (driver *linodeVolumeDriver) unmountVolume(name string, immediate bool) error {
 	api, err := driver.linodeAPI()
 	if err != nil {
 		return err
 	}
 
-	log.Infof("Unmount(%s)", req.Name)
+	log.Infof("Unmount(%s)", name)
 
-	linVol, err := driver.findVolumeByLabel(req.Name)
+	linVol, err := driver.findVolumeByLabel(name)
 	if err != nil {
 		return err
 	}
 
-	if err := Umount(driver.labelToMountPoint(linVol.Label)); err != nil {
-		return fmt.Errorf("Unable to Unmount(%s): %s", req.Name, err)
+	entry := driver.journal.begin(opUnmount, name)
+	defer driver.journal.finish(entry)
+	driver.journal.setVolumeID(entry, linVol.ID)
+
+	cfg := config()
+	if err := unmountWithPolicy(driver.labelToMountPoint(linVol.Label), cfg.BusyUnmountPolicy, cfg.BusyUnmountRetries); err != nil {
+		return fmt.Errorf("Unable to Unmount(%s): %s", name, err)
 	}
+	driver.journal.step(entry, stepUnmounted)
 
-	log.Infof("Unmount(): %s", req.Name)
+	log.Infof("Unmount(): %s", name)
+
+	// Nothing to detach if a previous Unmount got that far already
+	if linVol.LinodeID == nil || *linVol.LinodeID != driver.instanceID() {
+		return nil
+	}
+
+	// Keep the volume attached for a quick remount on this node
+	if delay := driver.volumeDetachDelay(linVol); delay > 0 && !immediate {
+		driver.scheduleDetach(linVol, delay)
+		return nil
+	}
+	driver.cancelDetach(linVol.ID)
 
 	// The volume is detached from the Linode at unmount
 	// to allow remote Linodes to infer whether a volume is
 	// mounted
-	if err := detachAndWait(api, linVol.ID); err != nil {
+	if err := driver.detachVolume(api, linVol); err != nil {
+		return err
+	}
+	driver.journal.step(entry, stepDetached)
+
+	return nil
+}
+
+// detachVolume detaches a volume from this node
+func (driver *linodeVolumeDriver) detachVolume(api *linodego.Client, linVol *linodego.Volume) error {
+	if err := driver.detachAndWait(api, linVol.ID); err != nil {
 		return err
 	}
 
+	// Make sure a later attach doesn't find the stale device link
+	if err := waitForDeviceFileRemoved(linVol.FilesystemPath, 30); err != nil {
+		log.Warnf("Device of volume %s still present after detach: %s", linVol.Label, err)
+	}
+
 	return nil
 }
 
@@ -480,13 +920,27 @@ func (driver *linodeVolumeDriver) Capabilities() *volume.CapabilitiesResponse {
 	return &volume.CapabilitiesResponse{Capabilities: volume.Capability{Scope: "global"}}
 }
 
+// instanceLabel returns the label of a Linode instance for messages
+func (driver *linodeVolumeDriver) instanceLabel(api *linodego.Client, linodeID int) string {
+	instance, err := api.GetInstance(context.Background(), linodeID)
+	if err != nil {
+		log.Warnf("Failed to look up linode %d: %s", linodeID, err)
+		return "unknown"
+	}
+	return instance.Label
+}
+
 // labelToMountPoint gets the mount-point for a volume
 func (driver *linodeVolumeDriver) labelToMountPoint(volumeLabel string) string {
 	return path.Join(driver.mountRoot, volumeLabel)
 }
 
-// findVolumeByLabel looks up linode volume by label
-func (driver *linodeVolumeDriver) findVolumeByLabel(volumeLabel string) (*linodego.Volume, error) {
+// findVolumeByLabel looks up the linode volume of a docker volume by its
+// prefixed label. Volumes outside the allowlist are reported with
+// errVolumeNotManaged.
+func (driver *linodeVolumeDriver) findVolumeByLabel(name string) (*linodego.Volume, error) {
+	label := volumeLabel(name)
+
 	var jsonFilter []byte
 	var err error
 	var linVols []linodego.Volume
@@ -496,7 +950,7 @@ func (driver *linodeVolumeDriver) findVolumeByLabel(volumeLabel string) (*linode
 		return nil, err
 	}
 
-	if jsonFilter, err = json.Marshal(map[string]string{"label": volumeLabel, "region": driver.region}); err != nil {
+	if jsonFilter, err = json.Marshal(map[string]string{"label": label, "region": driver.region()}); err != nil {
 		return nil, err
 	}
 
@@ -505,27 +959,53 @@ func (driver *linodeVolumeDriver) findVolumeByLabel(volumeLabel string) (*linode
 		return nil, err
 	}
 
-	if len(linVols) != 1 {
-		return nil, fmt.Errorf("Instance %d Volume with name %s not found", driver.instanceID, volumeLabel)
+	if len(linVols) == 0 {
+		return nil, fmt.Errorf("Instance %d Volume with name %s: %w", driver.instanceID(), label, errVolumeNotFound)
+	} else if len(linVols) != 1 {
+		return nil, fmt.Errorf("Instance %d found %d volumes with name %s", driver.instanceID(), len(linVols), label)
+	}
+
+	// Volumes outside the allowlist are never touched
+	if err := driver.volumeGuard().check(&linVols[0]); err != nil {
+		return nil, err
 	}
 
 	return &linVols[0], nil
 }
 
-func detachAndWait(api *linodego.Client, volumeID int) error {
+func (driver *linodeVolumeDriver) detachAndWait(api *linodego.Client, volumeID int) error {
+	mark, markErr := driver.events.mark()
+	if markErr != nil {
+		log.Warnf("Failed to read Linode events, falling back to polling: %s", markErr)
+	}
+
 	// Send detach request
 	if err := api.DetachVolume(context.Background(), volumeID); err != nil {
 		return fmt.Errorf("Error detaching volumeID(%d): %s", volumeID, err)
 	}
 
 	// Wait for linode to have the volume detached
-	if err := waitForLinodeVolumeDetachment(*api, volumeID, 180); err != nil {
+	var err error
+	if markErr == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 180*time.Second)
+		defer cancel()
+
+		err = driver.events.waitForVolumeEvent(ctx, mark, volumeID, linodego.ActionVolumeDetach)
+	} else {
+		err = waitForLinodeVolumeDetachment(*api, volumeID, 180)
+	}
+	if err != nil {
 		return fmt.Errorf("Error waiting for detachment of volumeID(%d): %s", volumeID, err)
 	}
 	return nil
 }
 
-func attachAndWait(api *linodego.Client, volumeID int, linodeID int) error {
+func (driver *linodeVolumeDriver) attachAndWait(api *linodego.Client, volumeID int, linodeID int) error {
+	mark, markErr := driver.events.mark()
+	if markErr != nil {
+		log.Warnf("Failed to read Linode events, falling back to polling: %s", markErr)
+	}
+
 	// attach
 	attachOpts := linodego.VolumeAttachOptions{LinodeID: linodeID}
 	if _, err := api.AttachVolume(context.Background(), volumeID, &attachOpts); err != nil {
@@ -535,56 +1015,76 @@ func attachAndWait(api *linodego.Client, volumeID int, linodeID int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Second)
 	defer cancel()
 
-	if _, err := api.WaitForVolumeLinodeID(ctx, volumeID, &linodeID); err != nil {
+	var err error
+	if markErr == nil {
+		err = driver.events.waitForVolumeEvent(ctx, mark, volumeID, linodego.ActionVolumeAttach)
+	} else {
+		_, err = api.WaitForVolumeLinodeID(ctx, volumeID, &linodeID)
+	}
+	if err != nil {
 		return fmt.Errorf("Error waiting for attachment of volume(%d) to linode(%d): %s", volumeID, linodeID, err)
 	}
 	return nil
 }
 
-// ensureVolumeAttached attempts to attach a volume to the current Linode instance
-func (driver *linodeVolumeDriver) ensureVolumeAttached(volumeID int) error {
+// ensureVolumeAttached attempts to attach a volume to the current Linode
+// instance. It returns whether the volume had to be attached.
+func (driver *linodeVolumeDriver) ensureVolumeAttached(volumeID int) (bool, error) {
 	// TODO: validate whether a volume is in use in a local container
 
 	api, err := driver.linodeAPI()
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// Wait for detachment if already detaching
-	if err := waitForVolumeNotBusy(api, volumeID); err != nil {
-		return err
+	if err := driver.waitForVolumeNotBusy(api, volumeID); err != nil {
+		return false, err
 	}
 
 	// Fetch volume
 	vol, err := api.GetVolume(context.Background(), volumeID)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	// If volume is already attached, do nothing
-	if vol.LinodeID != nil && *vol.LinodeID == driver.instanceID {
-		return nil
+	if vol.LinodeID != nil && *vol.LinodeID == driver.instanceID() {
+		return false, nil
 	}
 
-	// Forcibly attach the volume if forceAttach is enabled
-	if forceAttach && vol.LinodeID != nil && *vol.LinodeID != driver.instanceID {
-		if err := detachAndWait(api, volumeID); err != nil {
-			return err
+	// Make sure there is a free volume slot before detaching from elsewhere
+	if vol.LinodeID != nil {
+		if err := driver.checkVolumeSlot(api); err != nil {
+			return false, err
+		}
+	}
+
+	// Forcibly attach the volume if force-attach is enabled
+	if config().ForceAttach && vol.LinodeID != nil && *vol.LinodeID != driver.instanceID() {
+		if err := driver.detachAndWait(api, volumeID); err != nil {
+			return false, err
 		}
 
-		return attachAndWait(api, volumeID, driver.instanceID)
+		return true, driver.attachToSlot(api, volumeID)
 	}
 
-	// Throw an error if the instance is not in an attachable state
-	if vol.LinodeID != nil && *vol.LinodeID != driver.instanceID {
-		return fmt.Errorf("failed to attach volume: volume is currently attached to linode %d", *vol.LinodeID)
+	// Ask the other node to release the volume if it is only keeping it
+	// attached while idle, otherwise it is in use there
+	if vol.LinodeID != nil && *vol.LinodeID != driver.instanceID() {
+		if !hasTag(vol.Tags, detachIdleTag) {
+			return false, fmt.Errorf("failed to attach volume: volume is currently attached to linode %d", *vol.LinodeID)
+		}
+		if err := driver.requestDetach(api, vol); err != nil {
+			return false, fmt.Errorf("failed to attach volume: %s", err)
+		}
 	}
 
-	return attachAndWait(api, volumeID, driver.instanceID)
+	return true, driver.attachToSlot(api, volumeID)
 }
 
 // waitForVolumeNotBusy checks whether a volume is currently busy.
-func waitForVolumeNotBusy(api *linodego.Client, volumeID int) error {
+func (driver *linodeVolumeDriver) waitForVolumeNotBusy(api *linodego.Client, volumeID int) error {
 	vol, err := api.GetVolume(context.Background(), volumeID)
 	if err != nil {
 		return err
@@ -606,45 +1106,26 @@ func waitForVolumeNotBusy(api *linodego.Client, volumeID int) error {
 		return err
 	}
 
+	// Only the most recent page of events can still be in progress
 	events, err := api.ListEvents(context.Background(),
-		&linodego.ListOptions{Filter: string(detachFilterStr)})
+		linodego.NewListOptions(1, string(detachFilterStr)))
 	if err != nil {
 		return err
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
 	for _, event := range events {
 		if event.Status != linodego.EventStarted {
 			continue
 		}
 
-		if err := waitForEventFinished(api, event.ID); err != nil {
+		// a failed event leaves the volume idle as well
+		if err := driver.events.waitForEvent(ctx, event.ID); err != nil && ctx.Err() != nil {
 			return err
 		}
 	}
 
 	return nil
 }
-
-func waitForEventFinished(api *linodego.Client, eventID int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(60)*time.Second)
-	defer cancel()
-
-	ticker := time.NewTicker(2000 * time.Millisecond)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			event, err := api.GetEvent(ctx, eventID)
-			if err != nil {
-				return err
-			}
-
-			if event.Status == linodego.EventFinished || event.Status == linodego.EventFailed {
-				return nil
-			}
-
-		case <-ctx.Done():
-			return fmt.Errorf("error waiting for event(%d) completion: %v", eventID, ctx.Err())
-		}
-	}
-}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/linode/linodego/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// eventPollInterval is how often /account/events is tailed while waiters exist
+	eventPollInterval = 2 * time.Second
+
+	// eventRecentSize is the number of completed events kept around so that
+	// a waiter registered after its event finished still sees it
+	eventRecentSize = 64
+)
+
+// volumeEventActions are the event actions dispatched to waiters
+var volumeEventActions = map[linodego.EventAction]bool{
+	linodego.ActionVolumeAttach: true,
+	linodego.ActionVolumeDetach: true,
+	linodego.ActionVolumeCreate: true,
+	linodego.ActionVolumeResize: true,
+	linodego.ActionVolumeDelete: true,
+}
+
+// eventSource is the part of the Linode API the event watcher uses
+type eventSource interface {
+	ListEvents(ctx context.Context, opts *linodego.ListOptions) ([]linodego.Event, error)
+	GetEvent(ctx context.Context, eventID int) (*linodego.Event, error)
+}
+
+// eventWatcher tails the account event stream from a cursor and dispatches
+// completed volume events to waiters. The stream is only polled while at
+// least one waiter is registered.
+type eventWatcher struct {
+	api      func() (eventSource, error)
+	interval time.Duration
+
+	mutex   sync.Mutex
+	cursor  int
+	running bool
+	waiters map[*eventWaiter]struct{}
+	pending map[int]struct{}
+	recent  []linodego.Event
+}
+
+// eventWaiter matches either a single event by ID or the first completed
+// event for a volume and action newer than a cursor mark.
+type eventWaiter struct {
+	eventID  int
+	volumeID int
+	action   linodego.EventAction
+	after    int
+	done     chan linodego.Event
+}
+
+func newEventWatcher(api func() (eventSource, error)) *eventWatcher {
+	return &eventWatcher{
+		api:      api,
+		interval: eventPollInterval,
+		waiters:  make(map[*eventWaiter]struct{}),
+		pending:  make(map[int]struct{}),
+	}
+}
+
+// mark returns the current event cursor. It must be taken before the API
+// call whose completion is going to be waited on. While nobody waits, the
+// cursor moves to the head of the stream; waiters holding an older mark
+// catch up on their volume when they register.
+func (w *eventWatcher) mark() (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.running {
+		return w.cursor, nil
+	}
+
+	// the cursor is stale while nobody is waiting, move it to the head
+	// of the stream so the next poll only fetches new events
+	latest, err := w.latestEventID()
+	if err != nil {
+		return 0, err
+	}
+	if latest > w.cursor {
+		w.cursor = latest
+	}
+
+	return w.cursor, nil
+}
+
+// waitForVolumeEvent blocks until an event with action for volumeID newer
+// than mark completes, or ctx is done.
+func (w *eventWatcher) waitForVolumeEvent(ctx context.Context, mark, volumeID int, action linodego.EventAction) error {
+	return w.wait(ctx, &eventWaiter{
+		volumeID: volumeID,
+		action:   action,
+		after:    mark,
+		done:     make(chan linodego.Event, 1),
+	})
+}
+
+// waitForEvent blocks until the event eventID completes, or ctx is done.
+func (w *eventWatcher) waitForEvent(ctx context.Context, eventID int) error {
+	// an older event is refreshed by its ID, the stream itself is only
+	// tailed from the head
+	if _, err := w.mark(); err != nil {
+		return err
+	}
+
+	return w.wait(ctx, &eventWaiter{
+		eventID: eventID,
+		done:    make(chan linodego.Event, 1),
+	})
+}
+
+func (w *eventWatcher) wait(ctx context.Context, waiter *eventWaiter) error {
+	w.mutex.Lock()
+	event, found := w.findRecent(waiter)
+	catchUp := false
+	if !found {
+		w.waiters[waiter] = struct{}{}
+		if waiter.eventID != 0 {
+			w.pending[waiter.eventID] = struct{}{}
+		}
+		// the cursor may have moved past the events of an older mark
+		catchUp = waiter.eventID == 0 && waiter.after < w.cursor
+		if !w.running {
+			w.running = true
+			go w.run()
+		}
+	}
+	w.mutex.Unlock()
+
+	if catchUp {
+		if err := w.catchUp(waiter); err != nil {
+			log.Warnf("Failed to look up earlier events for %s: %s", waiter, err)
+		}
+	}
+
+	if !found {
+		select {
+		case event = <-waiter.done:
+		case <-ctx.Done():
+			w.mutex.Lock()
+			delete(w.waiters, waiter)
+			w.mutex.Unlock()
+			return fmt.Errorf("error waiting for %s: %v", waiter, ctx.Err())
+		}
+	}
+
+	if event.Status == linodego.EventFailed {
+		return fmt.Errorf("event %d (%s) for volume %d failed", event.ID, event.Action, eventEntityID(event))
+	}
+
+	log.Debugf("event %d (%s) for volume %d completed", event.ID, event.Action, eventEntityID(event))
+	return nil
+}
+
+// run polls the event stream until no waiters are left
+func (w *eventWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := w.poll(); err != nil {
+			log.Warnf("Failed to poll Linode events: %s", err)
+		}
+
+		w.mutex.Lock()
+		if len(w.waiters) == 0 {
+			w.running = false
+			w.mutex.Unlock()
+			return
+		}
+		w.mutex.Unlock()
+	}
+}
+
+// poll fetches volume events newer than the cursor, refreshes the events
+// that were still in progress and dispatches the completed ones.
+func (w *eventWatcher) poll() error {
+	api, err := w.api()
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	cursor := w.cursor
+	pending := make([]int, 0, len(w.pending))
+	for id := range w.pending {
+		pending = append(pending, id)
+	}
+	w.mutex.Unlock()
+
+	filter := linodego.Filter{}
+	filter.AddField(linodego.Gt, "id", cursor)
+	filter.AddField(linodego.Eq, "entity.type", "volume")
+
+	filterStr, err := filter.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	events, err := api.ListEvents(context.Background(), &linodego.ListOptions{Filter: string(filterStr)})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range pending {
+		if id <= cursor {
+			event, err := api.GetEvent(context.Background(), id)
+			if linodego.IsNotFound(err) {
+				w.mutex.Lock()
+				delete(w.pending, id)
+				w.mutex.Unlock()
+				continue
+			} else if err != nil {
+				log.Warnf("Failed to refresh event %d: %s", id, err)
+				continue
+			}
+			events = append(events, *event)
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, event := range events {
+		if event.ID > w.cursor {
+			w.cursor = event.ID
+		}
+		w.dispatch(event)
+	}
+
+	return nil
+}
+
+// catchUp dispatches the events of the volume of waiter newer than its mark
+func (w *eventWatcher) catchUp(waiter *eventWaiter) error {
+	api, err := w.api()
+	if err != nil {
+		return err
+	}
+
+	filter := linodego.Filter{}
+	filter.AddField(linodego.Gt, "id", waiter.after)
+	filter.AddField(linodego.Eq, "entity.type", "volume")
+	filter.AddField(linodego.Eq, "entity.id", waiter.volumeID)
+
+	filterStr, err := filter.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	events, err := api.ListEvents(context.Background(), &linodego.ListOptions{Filter: string(filterStr)})
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, event := range events {
+		w.dispatch(event)
+	}
+	return nil
+}
+
+// dispatch delivers a completed event to its waiters, or tracks it as
+// pending while it is still in progress. Events in progress are tracked even
+// without a matching waiter, as the cursor moves past them and a waiter may
+// only register once the API call that started them has returned. Callers
+// must hold the mutex.
+func (w *eventWatcher) dispatch(event linodego.Event) {
+	if !volumeEventActions[event.Action] {
+		return
+	}
+
+	if !eventCompleted(event) {
+		w.pending[event.ID] = struct{}{}
+		return
+	}
+
+	delete(w.pending, event.ID)
+
+	w.recent = append(w.recent, event)
+	if len(w.recent) > eventRecentSize {
+		w.recent = w.recent[len(w.recent)-eventRecentSize:]
+	}
+
+	for waiter := range w.waiters {
+		if waiter.matches(event) {
+			waiter.done <- event
+			delete(w.waiters, waiter)
+		}
+	}
+}
+
+// findRecent looks for an already completed event matching waiter.
+// Callers must hold the mutex.
+func (w *eventWatcher) findRecent(waiter *eventWaiter) (linodego.Event, bool) {
+	for _, event := range w.recent {
+		if waiter.matches(event) {
+			return event, true
+		}
+	}
+	return linodego.Event{}, false
+}
+
+// latestEventID returns the ID of the newest event on the account
+func (w *eventWatcher) latestEventID() (int, error) {
+	api, err := w.api()
+	if err != nil {
+		return 0, err
+	}
+
+	filter := linodego.Filter{}
+	filter.OrderBy = "created"
+	filter.Order = "desc"
+
+	filterStr, err := filter.MarshalJSON()
+	if err != nil {
+		return 0, err
+	}
+
+	events, err := api.ListEvents(context.Background(), linodego.NewListOptions(1, string(filterStr)))
+	if err != nil {
+		return 0, err
+	}
+
+	latest := 0
+	for _, event := range events {
+		if event.ID > latest {
+			latest = event.ID
+		}
+	}
+	return latest, nil
+}
+
+func (waiter *eventWaiter) matches(event linodego.Event) bool {
+	if waiter.eventID != 0 {
+		return event.ID == waiter.eventID
+	}
+
+	return event.ID > waiter.after &&
+		event.Action == waiter.action &&
+		eventEntityID(event) == waiter.volumeID
+}
+
+func (waiter *eventWaiter) String() string {
+	if waiter.eventID != 0 {
+		return fmt.Sprintf("event(%d)", waiter.eventID)
+	}
+	return fmt.Sprintf("%s of volume(%d)", waiter.action, waiter.volumeID)
+}
+
+// eventCompleted reports whether an event has reached a terminal status
+func eventCompleted(event linodego.Event) bool {
+	switch event.Status {
+	case linodego.EventFinished, linodego.EventFailed, linodego.EventNotification:
+		return true
+	}
+	return false
+}
+
+// eventEntityID returns the numeric ID of the entity of an event, or 0
+func eventEntityID(event linodego.Event) int {
+	if event.Entity == nil {
+		return 0
+	}
+
+	switch id := event.Entity.ID.(type) {
+	case float64:
+		return int(id)
+	case int:
+		return id
+	}
+	return 0
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/linode/linodego/v2"
+)
+
+// fakeEvents is an event stream that answers the filters the watcher sends
+type fakeEvents struct {
+	mutex   sync.Mutex
+	events  map[int]linodego.Event
+	filters []map[string]any
+}
+
+func newFakeEvents() *fakeEvents {
+	return &fakeEvents{events: map[int]linodego.Event{}}
+}
+
+func (f *fakeEvents) put(id, volumeID int, action linodego.EventAction, status linodego.EventStatus) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.events[id] = linodego.Event{
+		ID:     id,
+		Action: action,
+		Status: status,
+		Entity: &linodego.EventEntity{ID: float64(volumeID), Type: linodego.EntityVolume},
+	}
+}
+
+func (f *fakeEvents) ListEvents(_ context.Context, opts *linodego.ListOptions) ([]linodego.Event, error) {
+	filter := map[string]any{}
+	if err := json.Unmarshal([]byte(opts.Filter), &filter); err != nil {
+		return nil, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.filters = append(f.filters, filter)
+
+	var events []linodego.Event
+	for _, event := range f.events {
+		if id, ok := filter["id"].(map[string]any); ok && float64(event.ID) <= id["+gt"].(float64) {
+			continue
+		}
+		if entityType, ok := filter["entity.type"]; ok && string(event.Entity.Type) != entityType {
+			continue
+		}
+		if entityID, ok := filter["entity.id"]; ok && event.Entity.ID != entityID {
+			continue
+		}
+		events = append(events, event)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if filter["+order"] == "desc" {
+			return events[i].ID > events[j].ID
+		}
+		return events[i].ID < events[j].ID
+	})
+	return events, nil
+}
+
+func (f *fakeEvents) GetEvent(_ context.Context, eventID int) (*linodego.Event, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	event, ok := f.events[eventID]
+	if !ok {
+		return nil, &linodego.Error{Code: http.StatusNotFound}
+	}
+	return &event, nil
+}
+
+// listedFrom reports whether the stream was listed with an id filter of after
+func (f *fakeEvents) listedFrom(after int) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, filter := range f.filters {
+		if id, ok := filter["id"].(map[string]any); ok && id["+gt"] == float64(after) {
+			return true
+		}
+	}
+	return false
+}
+
+func newTestWatcher(source *fakeEvents) *eventWatcher {
+	w := newEventWatcher(func() (eventSource, error) {
+		return source, nil
+	})
+	w.interval = time.Millisecond
+	return w
+}
+
+func waitIdle(t *testing.T, w *eventWatcher) {
+	t.Helper()
+
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(time.Millisecond) {
+		w.mutex.Lock()
+		running := w.running
+		w.mutex.Unlock()
+		if !running {
+			return
+		}
+	}
+	t.Fatal("event watcher did not stop")
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestEventWatcherKeepsEventsOfOlderMarks(t *testing.T) {
+	source := newFakeEvents()
+	source.put(10, 9, linodego.ActionVolumeCreate, linodego.EventFinished)
+	w := newTestWatcher(source)
+
+	markA, err := w.mark()
+	if err != nil {
+		t.Fatal(err)
+	}
+	markB, err := w.mark()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A's attach finishes before A waits, B's wait polls past it
+	source.put(11, 1, linodego.ActionVolumeAttach, linodego.EventFinished)
+	source.put(12, 2, linodego.ActionVolumeAttach, linodego.EventFinished)
+	if err := w.waitForVolumeEvent(testContext(t), markB, 2, linodego.ActionVolumeAttach); err != nil {
+		t.Fatal(err)
+	}
+	waitIdle(t, w)
+
+	// C takes a mark while nobody waits
+	if _, err := w.mark(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.waitForVolumeEvent(testContext(t), markA, 1, linodego.ActionVolumeAttach); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEventWatcherCatchesUpAfterIdleMark(t *testing.T) {
+	source := newFakeEvents()
+	source.put(10, 9, linodego.ActionVolumeCreate, linodego.EventFinished)
+	w := newTestWatcher(source)
+
+	markA, err := w.mark()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nobody polled A's event before another mark moved the cursor past it
+	source.put(11, 1, linodego.ActionVolumeDetach, linodego.EventStarted)
+	if _, err := w.mark(); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		source.put(11, 1, linodego.ActionVolumeDetach, linodego.EventFinished)
+	}()
+
+	if err := w.waitForVolumeEvent(testContext(t), markA, 1, linodego.ActionVolumeDetach); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEventWatcherFailedEvent(t *testing.T) {
+	source := newFakeEvents()
+	w := newTestWatcher(source)
+
+	mark, err := w.mark()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source.put(1, 1, linodego.ActionVolumeResize, linodego.EventFailed)
+	if err := w.waitForVolumeEvent(testContext(t), mark, 1, linodego.ActionVolumeResize); err == nil {
+		t.Fatal("waitForVolumeEvent() of a failed event succeeded")
+	}
+}
+
+func TestEventWatcherWaitForOlderEvent(t *testing.T) {
+	source := newFakeEvents()
+	source.put(5, 1, linodego.ActionVolumeCreate, linodego.EventStarted)
+	source.put(20, 2, linodego.ActionVolumeDelete, linodego.EventFinished)
+	w := newTestWatcher(source)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		source.put(5, 1, linodego.ActionVolumeCreate, linodego.EventFinished)
+	}()
+
+	if err := w.waitForEvent(testContext(t), 5); err != nil {
+		t.Fatal(err)
+	}
+	if source.listedFrom(0) {
+		t.Error("waitForEvent() listed the event stream from its start")
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 // Format calls mke2fs on path
@@ -15,42 +20,101 @@ func Format(path string, formatFSType string) error {
 	return err
 }
 
-// Mount mounts device to mountpoint
-func Mount(device string, mountpoint string) error {
-	log.Debugf("calling mount %s %s", device, mountpoint)
-	cmd := exec.Command("mount", device, mountpoint)
-	output, err := cmd.CombinedOutput()
-	log.Debugf("Mount Output:\n%s", string(output))
-	return err
+// Mount mounts device to mountpoint and returns whether it did. It succeeds
+// without doing anything if device is already mounted there.
+func Mount(device string, mountpoint string, fsType string) (bool, error) {
+	log.Debugf("calling mount %s %s (%s)", device, mountpoint, fsType)
+
+	current, err := findMount(mountpoint)
+	if err != nil {
+		return false, err
+	}
+
+	if current != nil {
+		majorMinor, err := deviceMajorMinor(device)
+		if err != nil {
+			return false, err
+		}
+		if current.MajorMinor != majorMinor {
+			return false, fmt.Errorf("%s is already mounted on %s", current.Source, mountpoint)
+		}
+
+		log.Infof("%s is already mounted on %s", device, mountpoint)
+		return false, nil
+	}
+
+	if err := unix.Mount(device, mountpoint, fsType, 0, ""); err != nil {
+		return false, fmt.Errorf("mount %s on %s failed: %w", device, mountpoint, err)
+	}
+	return true, nil
 }
 
-// Umount calls umount command
+// Umount unmounts mountpoint. It succeeds without doing anything if nothing
+// is mounted there.
 func Umount(mountpoint string) error {
-	cmd := exec.Command("umount", mountpoint)
-	output, err := cmd.CombinedOutput()
-	log.Debugf("Umount Output:\n%s", string(output))
-	return err
+	mounted, err := isMounted(mountpoint)
+	if err != nil {
+		return err
+	}
+
+	if !mounted {
+		log.Infof("%s is not mounted", mountpoint)
+		return nil
+	}
+
+	if err := unix.Unmount(mountpoint, 0); err != nil {
+		return fmt.Errorf("umount %s failed: %w", mountpoint, err)
+	}
+	return nil
 }
 
 // GetFSType returns the filesystem type from a block device
-// function based on https://github.com/yholkamp/ovh-docker-volume-plugin/blob/master/utils.go
 func GetFSType(device string) string {
 	log.Infof("GetFSType(%s)", device)
-	fsType := ""
-	out, err := exec.Command("blkid", device).CombinedOutput()
+	result, err := ProbeDevice(device)
 	if err != nil {
-		return fsType
+		log.Warnf("Failed to probe device %s: %s", device, err)
+		return ""
 	}
 
-	if strings.Contains(string(out), "TYPE=") {
-		for _, v := range strings.Split(string(out), " ") {
-			if strings.Contains(v, "TYPE=") {
-				fsType = strings.Split(v, "=")[1]
-				fsType = strings.ReplaceAll(fsType, "\"", "")
-			}
-		}
+	log.Infof("GetFSType(): %s", result.Type)
+	return result.Type
+}
+
+// GetFSUUID returns the filesystem UUID of a block device
+func GetFSUUID(device string) string {
+	result, err := ProbeDevice(device)
+	if err != nil {
+		log.Warnf("Failed to probe device %s: %s", device, err)
+		return ""
+	}
+
+	return result.UUID
+}
+
+// GetSignatures returns the types of all filesystem, RAID, partition table
+// and other signatures wipefs finds on a block device
+func GetSignatures(device string) ([]string, error) {
+	out, err := exec.Command("wipefs", "--no-act", "--noheadings", "--output", "TYPE", device).Output()
+	if err != nil {
+		return nil, fmt.Errorf("wipefs %s failed: %s", device, err)
+	}
+
+	return strings.Fields(string(out)), nil
+}
+
+// IsZeroed returns whether the first size bytes of a block device are zero
+func IsZeroed(device string, size int64) (bool, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf, err := io.ReadAll(io.LimitReader(f, size))
+	if err != nil {
+		return false, err
 	}
 
-	log.Infof("GetFSType(): %s", fsType)
-	return fsType
+	return len(bytes.TrimLeft(buf, "\x00")) == 0, nil
 }
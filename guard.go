@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/linode/linodego/v2"
+)
+
+var errVolumeNotManaged = errors.New("volume is outside the volume allowlist")
+
+// maxLabelLength is the longest label the Linode API accepts for volumes
+const maxLabelLength = 32
+
+var labelPrefixPattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]*$`)
+
+// volumeLabel maps a Docker volume name to the label of its Linode volume
+func volumeLabel(name string) string {
+	return config().LabelPrefix + name
+}
+
+// volumeName maps the label of a Linode volume back to its Docker volume name
+func volumeName(label string) string {
+	return strings.TrimPrefix(label, config().LabelPrefix)
+}
+
+// volumeGuard restricts the plugin to the volumes matching every configured
+// condition, so unrelated volumes of the account are never touched
+type volumeGuard struct {
+	namespace   string
+	labelRegex  *regexp.Regexp
+	labelPrefix string
+	requiredTag string
+}
+
+func newVolumeGuard(c *Config) (*volumeGuard, error) {
+	g := &volumeGuard{namespace: c.LabelPrefix, labelPrefix: c.VolumeLabelPrefix, requiredTag: c.VolumeRequiredTag}
+	if c.VolumeLabelRegex != "" {
+		re, err := regexp.Compile(c.VolumeLabelRegex)
+		if err != nil {
+			return nil, fmt.Errorf("volume-label-regex: %s", err)
+		}
+		g.labelRegex = re
+	}
+	return g, nil
+}
+
+// volumeGuard returns the guard of the current configuration
+func (driver *linodeVolumeDriver) volumeGuard() *volumeGuard {
+	return config().guard
+}
+
+// checkLabel returns why a volume with label can't be managed, or nil
+func (g *volumeGuard) checkLabel(label string) error {
+	if !strings.HasPrefix(label, g.namespace) {
+		return fmt.Errorf("label %s is outside the %s namespace: %w", label, g.namespace, errVolumeNotManaged)
+	}
+	if g.labelPrefix != "" && !strings.HasPrefix(label, g.labelPrefix) {
+		return fmt.Errorf("label %s does not start with %q: %w", label, g.labelPrefix, errVolumeNotManaged)
+	}
+	if g.labelRegex != nil && !g.labelRegex.MatchString(label) {
+		return fmt.Errorf("label %s does not match %q: %w", label, g.labelRegex, errVolumeNotManaged)
+	}
+	return nil
+}
+
+// check returns why linVol can't be managed, or nil
+func (g *volumeGuard) check(linVol *linodego.Volume) error {
+	if err := g.checkLabel(linVol.Label); err != nil {
+		return err
+	}
+	if g.requiredTag != "" && !hasTag(linVol.Tags, g.requiredTag) {
+		return fmt.Errorf("volume %s is not tagged %s: %w", linVol.Label, g.requiredTag, errVolumeNotManaged)
+	}
+	return nil
+}
+
+func (g *volumeGuard) allows(linVol *linodego.Volume) bool {
+	return g.check(linVol) == nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	busyPolicyFail  = "fail"
+	busyPolicyRetry = "retry"
+	busyPolicyLazy  = "lazy"
+
+	// busyRetryInterval is the delay between unmount attempts of a busy volume
+	busyRetryInterval = 2 * time.Second
+)
+
+// mountHolder is a process keeping a mountpoint busy
+type mountHolder struct {
+	PID     int
+	Command string
+	Reasons []string
+}
+
+func (h mountHolder) String() string {
+	return fmt.Sprintf("%d (%s: %s)", h.PID, h.Command, strings.Join(h.Reasons, ","))
+}
+
+// unmountWithPolicy unmounts mountpoint. When it is busy, the unmount is
+// retried or done lazily depending on policy, and the processes holding it
+// are reported.
+func unmountWithPolicy(mountpoint string, policy string, retries int) error {
+	err := Umount(mountpoint)
+	if !errors.Is(err, unix.EBUSY) {
+		return err
+	}
+
+	if policy == busyPolicyRetry || policy == busyPolicyLazy {
+		for i := 0; i < retries && errors.Is(err, unix.EBUSY); i++ {
+			log.Infof("%s is busy, retrying unmount (%d/%d)", mountpoint, i+1, retries)
+			time.Sleep(busyRetryInterval)
+			err = Umount(mountpoint)
+		}
+		if !errors.Is(err, unix.EBUSY) {
+			return err
+		}
+	}
+
+	holders := describeMountHolders(findMountHolders(mountpoint))
+
+	if policy == busyPolicyLazy {
+		log.Warnf("%s is busy, held by %s; unmounting lazily", mountpoint, holders)
+		if err := unix.Unmount(mountpoint, unix.MNT_DETACH); err != nil {
+			return fmt.Errorf("lazy umount %s failed: %w", mountpoint, err)
+		}
+		// flush whatever was written so far before the device goes away
+		unix.Sync()
+		return nil
+	}
+
+	return fmt.Errorf("%s is busy, held by %s: %w", mountpoint, holders, err)
+}
+
+// findMountHolders scans /proc for processes with open files, a working
+// directory or root below mountpoint, or which have it mounted in their own
+// mount namespace.
+func findMountHolders(mountpoint string) []mountHolder {
+	mountpoint = filepath.Clean(mountpoint)
+	majorMinor := ""
+	if m, err := findMount(mountpoint); err == nil && m != nil {
+		majorMinor = m.MajorMinor
+	}
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		log.Warnf("Failed to list processes: %s", err)
+		return nil
+	}
+
+	self := os.Getpid()
+	selfNS, _ := os.Readlink("/proc/self/ns/mnt")
+	// the host namespace only sees the mount propagated from ours. The
+	// plugin shares the PID namespace of the host (pidhost), so pid 1 is
+	// the host init.
+	hostNS, _ := os.Readlink("/proc/1/ns/mnt")
+
+	var holders []mountHolder
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil || pid == self {
+			continue
+		}
+
+		procDir := filepath.Join("/proc", proc.Name())
+		var reasons []string
+
+		for _, link := range []string{"cwd", "root"} {
+			if target, err := os.Readlink(filepath.Join(procDir, link)); err == nil && isBelow(target, mountpoint) {
+				reasons = append(reasons, link)
+			}
+		}
+
+		if fds, err := os.ReadDir(filepath.Join(procDir, "fd")); err == nil {
+			for _, fd := range fds {
+				target, err := os.Readlink(filepath.Join(procDir, "fd", fd.Name()))
+				if err == nil && isBelow(target, mountpoint) {
+					reasons = append(reasons, "fd")
+					break
+				}
+			}
+		}
+
+		// processes sharing our mount namespace see the same mounts we do,
+		// only other namespaces (i.e. containers) can hold extra ones
+		ns, _ := os.Readlink(filepath.Join(procDir, "ns", "mnt"))
+		if majorMinor != "" && ns != selfNS && ns != hostNS {
+			if mounts, err := readMountInfo(filepath.Join(procDir, "mountinfo")); err == nil {
+				for _, m := range mounts {
+					if m.MajorMinor == majorMinor {
+						reasons = append(reasons, "mount:"+m.Mountpoint)
+						break
+					}
+				}
+			}
+		}
+
+		if len(reasons) == 0 {
+			continue
+		}
+
+		comm, _ := readTrimmedFile(filepath.Join(procDir, "comm"))
+		holders = append(holders, mountHolder{PID: pid, Command: comm, Reasons: reasons})
+	}
+
+	sort.Slice(holders, func(i, j int) bool { return holders[i].PID < holders[j].PID })
+	return holders
+}
+
+func describeMountHolders(holders []mountHolder) string {
+	if len(holders) == 0 {
+		return "unknown processes"
+	}
+
+	descriptions := make([]string, len(holders))
+	for i, h := range holders {
+		descriptions[i] = h.String()
+	}
+	return "pid " + strings.Join(descriptions, ", ")
+}
+
+// isBelow returns whether path is dir or inside of it
+func isBelow(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	metadata "github.com/linode/go-metadata"
+	"github.com/linode/linodego/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sources the ID of the current Linode can be resolved from
+const (
+	identitySourceLinodeID     = "linode-id"
+	identitySourceMetadata     = "metadata"
+	identitySourceInstanceData = "instance-data"
+	identitySourceIPv4         = "ipv4"
+	identitySourceIPv6         = "ipv6"
+	identitySourceLinkLocal    = "link-local"
+	identitySourceLabel        = "label"
+)
+
+// identityCacheFile caches the resolved identity in the state directory
+const identityCacheFile = "identity.json"
+
+// errIdentitySourceSkipped is returned by sources that are not configured or
+// not available on this host
+var errIdentitySourceSkipped = errors.New("source not available")
+
+// errIdentityMismatch is returned when the current Linode is not the one
+// an identity claims
+var errIdentityMismatch = errors.New("identity mismatch")
+
+// instanceIdentity is the current Linode as resolved by one source
+type instanceIdentity struct {
+	id     int
+	region string
+	label  string
+	source string
+}
+
+// identityCache is the on-disk form of a resolved identity
+type identityCache struct {
+	ID     int    `json:"id"`
+	Region string `json:"region"`
+	Label  string `json:"label"`
+	Source string `json:"source"`
+}
+
+type identityResolver func(driver *linodeVolumeDriver, api *linodego.Client) (*instanceIdentity, error)
+
+var identityResolvers = map[string]identityResolver{
+	identitySourceLinodeID:     identityFromLinodeID,
+	identitySourceMetadata:     identityFromMetadata,
+	identitySourceInstanceData: identityFromInstanceData,
+	identitySourceIPv4:         identityFromIPv4,
+	identitySourceIPv6:         identityFromIPv6,
+	identitySourceLinkLocal:    identityFromLinkLocal,
+	identitySourceLabel:        identityFromLabel,
+}
+
+// parseIdentitySources validates the comma separated identity-sources setting
+func parseIdentitySources(value string) ([]string, error) {
+	var sources []string
+	for _, source := range strings.Split(value, ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if _, ok := identityResolvers[source]; !ok {
+			return nil, fmt.Errorf("unknown identity source %q", source)
+		}
+		sources = append(sources, source)
+	}
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no identity sources configured")
+	}
+	return sources, nil
+}
+
+// determineLinodeID resolves the current Linode, preferring the identity
+// cached in the state directory by an earlier start once it is verified
+func (driver *linodeVolumeDriver) determineLinodeID() error {
+	if cached := driver.loadCachedIdentity(); cached != nil {
+		err := driver.verifyIdentity(driver.linodeAPIPtr, cached)
+		if err == nil {
+			log.Infof("Using cached Linode ID %d (resolved by %s)", cached.id, cached.source)
+			driver.setIdentity(cached)
+			return nil
+		}
+		log.Warnf("Cached Linode ID %d could not be verified, resolving it again: %s", cached.id, err)
+
+		// narrows down the lookups by address
+		driver.setIdentity(&instanceIdentity{region: cached.region})
+	}
+
+	identity, err := driver.resolveIdentity(driver.linodeAPIPtr)
+	if err != nil {
+		return err
+	}
+
+	driver.setIdentity(identity)
+	driver.saveCachedIdentity(identity)
+	return nil
+}
+
+// resolveIdentity queries the configured sources in order. The first source
+// that succeeds wins, unless identity-cross-check is set, in which case every
+// available source must agree.
+func (driver *linodeVolumeDriver) resolveIdentity(api *linodego.Client) (*instanceIdentity, error) {
+	sources, err := parseIdentitySources(config().IdentitySources)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolved *instanceIdentity
+	var errs []error
+	for _, source := range sources {
+		identity, err := identityResolvers[source](driver, api)
+		if errors.Is(err, errIdentitySourceSkipped) {
+			log.Debugf("Skipping identity source %s: %s", source, err)
+			continue
+		} else if err != nil {
+			log.Warnf("Failed to determine Linode ID from %s: %s", source, err)
+			errs = append(errs, fmt.Errorf("%s: %s", source, err))
+			continue
+		}
+		identity.source = source
+		log.Infof("Identity source %s resolved Linode ID %d", source, identity.id)
+
+		if resolved == nil {
+			resolved = identity
+			if !config().IdentityCrossCheck {
+				break
+			}
+		} else if identity.id != resolved.id {
+			return nil, fmt.Errorf("identity sources disagree: %s resolved Linode ID %d, %s resolved Linode ID %d",
+				resolved.source, resolved.id, identity.source, identity.id)
+		}
+	}
+
+	if resolved == nil {
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("Failed to determine Linode ID: none of the identity sources %s is available. "+
+				"Consider setting `linode-id` or `linode-label`.", strings.Join(sources, ","))
+		}
+		return nil, fmt.Errorf("Failed to determine Linode ID: %s", errors.Join(errs...))
+	}
+
+	if resolved.region == "" || resolved.label == "" {
+		instance, err := api.GetInstance(context.Background(), resolved.id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up linode %d resolved by %s: %s", resolved.id, resolved.source, err)
+		}
+		resolved.region = instance.Region
+		resolved.label = instance.Label
+	}
+
+	return resolved, nil
+}
+
+// setIdentity makes identity the current Linode. The identity may change
+// while requests are served once identity-auto-resolve is set.
+func (driver *linodeVolumeDriver) setIdentity(identity *instanceIdentity) {
+	driver.identity.Store(identity)
+}
+
+// instanceID returns the ID of the current Linode, or 0 until resolved
+func (driver *linodeVolumeDriver) instanceID() int {
+	if identity := driver.identity.Load(); identity != nil {
+		return identity.id
+	}
+	return 0
+}
+
+// region returns the region of the current Linode
+func (driver *linodeVolumeDriver) region() string {
+	if identity := driver.identity.Load(); identity != nil {
+		return identity.region
+	}
+	return ""
+}
+
+// identityError returns why Mounts are refused after the identity of this
+// host changed, or nil
+func (driver *linodeVolumeDriver) identityError() error {
+	driver.lifecycleMutex.Lock()
+	defer driver.lifecycleMutex.Unlock()
+
+	return driver.identityErr
+}
+
+func (driver *linodeVolumeDriver) setIdentityError(err error) {
+	driver.lifecycleMutex.Lock()
+	defer driver.lifecycleMutex.Unlock()
+
+	driver.identityErr = err
+}
+
+// verifyIdentityPeriodically re-verifies the current Linode every interval,
+// as a cloned or rebuilt host would otherwise keep attaching volumes to the
+// Linode it was resolved as
+func (driver *linodeVolumeDriver) verifyIdentityPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		driver.checkIdentity()
+	}
+}
+
+// checkIdentity refuses Mounts once this host is no longer the resolved
+// Linode, and resolves it again if identity-auto-resolve is set
+func (driver *linodeVolumeDriver) checkIdentity() {
+	api, err := driver.linodeAPI()
+	if err != nil {
+		return
+	}
+
+	current := driver.identity.Load()
+	if current == nil {
+		return
+	}
+	err = driver.verifyIdentity(api, current)
+	if err == nil {
+		if driver.identityError() != nil {
+			log.Infof("Verified Linode ID %d again, accepting mounts", current.id)
+			driver.setIdentityError(nil)
+		}
+		return
+	}
+	if !errors.Is(err, errIdentityMismatch) {
+		log.Warnf("Failed to verify Linode ID %d: %s", current.id, err)
+		return
+	}
+
+	log.Errorf("This host is no longer Linode %d, refusing mounts: %s", current.id, err)
+	driver.setIdentityError(fmt.Errorf("this host is no longer Linode %d: %s", current.id, err))
+
+	if !config().IdentityAutoResolve {
+		log.Error("Restart the plugin or enable identity-auto-resolve to resolve the Linode ID again")
+		return
+	}
+
+	identity, err := driver.resolveIdentity(api)
+	if err != nil {
+		log.Errorf("Failed to resolve the Linode ID again: %s", err)
+		return
+	}
+
+	driver.slotsMutex.Lock()
+	driver.instanceVolumeSlots = 0
+	driver.slotsMutex.Unlock()
+
+	driver.setIdentity(identity)
+	driver.saveCachedIdentity(identity)
+	driver.setIdentityError(nil)
+	log.Warnf("Resolved Linode ID %d again (was %d), accepting mounts", identity.id, current.id)
+}
+
+// loadCachedIdentity returns the identity cached by an earlier start, unless
+// the settings ask for a fresh resolution
+func (driver *linodeVolumeDriver) loadCachedIdentity() *instanceIdentity {
+	if config().IdentityCrossCheck {
+		return nil
+	}
+
+	b, err := os.ReadFile(path.Join(driver.stateDir, identityCacheFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Warnf("Failed to read cached identity: %s", err)
+		return nil
+	}
+
+	var cache identityCache
+	if err := json.Unmarshal(b, &cache); err != nil || cache.ID == 0 {
+		log.Warnf("Ignoring invalid cached identity")
+		return nil
+	}
+
+	if id := config().LinodeID; id != 0 && id != cache.ID {
+		log.Infof("linode-id changed from cached %d to %d", cache.ID, id)
+		return nil
+	}
+
+	return &instanceIdentity{id: cache.ID, region: cache.Region, label: cache.Label, source: cache.Source}
+}
+
+func (driver *linodeVolumeDriver) saveCachedIdentity(identity *instanceIdentity) {
+	if err := os.MkdirAll(driver.stateDir, 0o700); err != nil {
+		log.Warnf("Failed to cache identity: %s", err)
+		return
+	}
+
+	cache := identityCache{ID: identity.id, Region: identity.region, Label: identity.label, Source: identity.source}
+	if err := writeFileAtomic(path.Join(driver.stateDir, identityCacheFile), cache); err != nil {
+		log.Warnf("Failed to cache identity: %s", err)
+	}
+}
+
+// verifyIdentity checks that this host is the Linode of identity, asking the
+// metadata service if available and comparing addresses otherwise. Errors
+// wrapping errIdentityMismatch mean it is a different Linode.
+func (driver *linodeVolumeDriver) verifyIdentity(api *linodego.Client, identity *instanceIdentity) error {
+	instance, err := api.GetInstance(context.Background(), identity.id)
+	if linodego.IsNotFound(err) {
+		return fmt.Errorf("linode %d does not exist: %w", identity.id, errIdentityMismatch)
+	} else if err != nil {
+		return fmt.Errorf("failed to look up linode %d: %s", identity.id, err)
+	}
+
+	if identity.region != "" && instance.Region != identity.region {
+		return fmt.Errorf("linode %d moved from %s to %s: %w", identity.id, identity.region, instance.Region, errIdentityMismatch)
+	}
+
+	if metadataServicesAvailable() {
+		meta, err := identityFromMetadata(driver, api)
+		if err == nil {
+			if meta.id != identity.id {
+				return fmt.Errorf("metadata service reports linode %d instead of %d: %w", meta.id, identity.id, errIdentityMismatch)
+			}
+			return nil
+		}
+		log.Debugf("Failed to verify identity with the metadata service: %s", err)
+	}
+
+	hostIPs, err := localAddresses(linodeIPv4)
+	if err != nil {
+		return err
+	}
+	for _, ip := range instance.IPv4 {
+		for _, hostIP := range hostIPs {
+			if ip != nil && ip.Equal(hostIP) {
+				return nil
+			}
+		}
+	}
+
+	linkLocal, err := resolveMachineLinkLocal()
+	if err != nil {
+		return fmt.Errorf("linode %d has none of the addresses %s: %w", identity.id, joinIPs(hostIPs), errIdentityMismatch)
+	}
+
+	ips, err := api.GetInstanceIPAddresses(context.Background(), identity.id)
+	if err != nil {
+		return fmt.Errorf("failed to get ip addresses for instance %d: %s", identity.id, err)
+	}
+	if ips.IPv6 == nil || ips.IPv6.LinkLocal == nil || ips.IPv6.LinkLocal.Address != linkLocal {
+		return fmt.Errorf("linode %d has none of the addresses %s, %s: %w", identity.id, joinIPs(hostIPs), linkLocal, errIdentityMismatch)
+	}
+	return nil
+}
+
+// identityFromLinodeID uses the linode-id setting
+func identityFromLinodeID(driver *linodeVolumeDriver, api *linodego.Client) (*instanceIdentity, error) {
+	id := config().LinodeID
+	if id == 0 {
+		return nil, fmt.Errorf("linode-id is not set: %w", errIdentitySourceSkipped)
+	}
+	return &instanceIdentity{id: id}, nil
+}
+
+func metadataServicesAvailable() bool {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:80", metadata.APIHost), 2*time.Second)
+	if err != nil {
+		return false
+	}
+
+	conn.Close()
+	return true
+}
+
+// identityFromMetadata asks the Linode metadata service
+func identityFromMetadata(driver *linodeVolumeDriver, api *linodego.Client) (*instanceIdentity, error) {
+	if !metadataServicesAvailable() {
+		return nil, fmt.Errorf("metadata service is not reachable: %w", errIdentitySourceSkipped)
+	}
+
+	client, err := metadata.NewClient(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	instanceInfo, err := client.GetInstance(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return &instanceIdentity{id: instanceInfo.ID, region: instanceInfo.Region, label: instanceInfo.Label}, nil
+}
+
+// cloudInitInstanceData is the part of the cloud-init instance-data file
+// that identifies the instance
+type cloudInitInstanceData struct {
+	V1 struct {
+		CloudName  string `json:"cloud_name"`
+		InstanceID string `json:"instance_id"`
+		Region     string `json:"region"`
+	} `json:"v1"`
+}
+
+// identityFromInstanceData reads the instance-data file cloud-init writes on
+// boot
+func identityFromInstanceData(driver *linodeVolumeDriver, api *linodego.Client) (*instanceIdentity, error) {
+	file := config().InstanceDataFile
+	b, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s does not exist: %w", file, errIdentitySourceSkipped)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var data cloudInitInstanceData
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", file, err)
+	}
+
+	if data.V1.CloudName != "" && data.V1.CloudName != "linode" {
+		return nil, fmt.Errorf("%s was written for cloud %q: %w", file, data.V1.CloudName, errIdentitySourceSkipped)
+	}
+
+	id, err := strconv.Atoi(data.V1.InstanceID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid instance_id %q in %s", data.V1.InstanceID, file)
+	}
+
+	return &instanceIdentity{id: id, region: data.V1.Region}, nil
+}
+
+// localAddresses returns the addresses of all interfaces accepted by keep
+func localAddresses(keep func(ip net.IP) bool) ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ifa, ok := addr.(*net.IPNet); ok && keep(ifa.IP) {
+			ips = append(ips, ifa.IP)
+		}
+	}
+	return ips, nil
+}
+
+// publicUnicast returns whether ip can be one of the public addresses of a
+// Linode
+func publicUnicast(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// linodeIPv4 returns whether ip can be one of the public or private IPv4
+// addresses of a Linode
+func linodeIPv4(ip net.IP) bool {
+	return ip.To4() != nil && ip.IsGlobalUnicast()
+}
+
+// listInstancesByIPv4 lists the instances owning any of ips, in region if
+// it is known, filtering on the server
+func listInstancesByIPv4(api *linodego.Client, ips []net.IP, region string) ([]linodego.Instance, error) {
+	ipFilters := make([]map[string]string, len(ips))
+	for i, ip := range ips {
+		ipFilters[i] = map[string]string{"ipv4": ip.String()}
+	}
+
+	filter := map[string]interface{}{"+or": ipFilters}
+	if region != "" {
+		filter["region"] = region
+	}
+
+	jsonFilter, err := json.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	instances, err := api.ListInstances(context.Background(), linodego.NewListOptions(0, string(jsonFilter)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances: %s", err)
+	}
+	return instances, nil
+}
+
+// identityFromIPv4 finds the Linode having one of the public IPv4 addresses
+// of this host
+func identityFromIPv4(driver *linodeVolumeDriver, api *linodego.Client) (*instanceIdentity, error) {
+	ips, err := localAddresses(func(ip net.IP) bool { return ip.To4() != nil && publicUnicast(ip) })
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no public IPv4 address found: %w", errIdentitySourceSkipped)
+	}
+
+	instances, err := listInstancesByIPv4(api, ips, driver.region())
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(instances) {
+	case 0:
+		return nil, fmt.Errorf("no instance has any of the addresses %s", joinIPs(ips))
+	case 1:
+		return &instanceIdentity{id: instances[0].ID, region: instances[0].Region, label: instances[0].Label}, nil
+	default:
+		return nil, fmt.Errorf("%d instances have the addresses %s", len(instances), joinIPs(ips))
+	}
+}
+
+// identityFromIPv6 finds the Linode having one of the public SLAAC addresses
+// of this host
+func identityFromIPv6(driver *linodeVolumeDriver, api *linodego.Client) (*instanceIdentity, error) {
+	ips, err := localAddresses(func(ip net.IP) bool { return ip.To4() == nil && publicUnicast(ip) })
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no public IPv6 address found: %w", errIdentitySourceSkipped)
+	}
+
+	// The SLAAC address can't be filtered on, so it is matched locally
+	instances, err := api.ListInstances(context.Background(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances: %s", err)
+	}
+
+	for _, instance := range instances {
+		slaac, _, err := net.ParseCIDR(instance.IPv6)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(slaac) {
+				return &instanceIdentity{id: instance.ID, region: instance.Region, label: instance.Label}, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no instance has any of the addresses %s", joinIPs(ips))
+}
+
+func joinIPs(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// resolveMachineLinkLocal returns the IPv6 link-local address of the
+// identity-interface
+func resolveMachineLinkLocal() (string, error) {
+	ifaceName := config().IdentityInterface
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", err, errIdentitySourceSkipped)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", err
+	}
+
+	for _, addr := range addrs {
+		if ifa, ok := addr.(*net.IPNet); ok {
+			if ifa.IP.To4() != nil {
+				continue
+			}
+
+			if !ifa.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			return ifa.IP.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("no link local ipv6 address found on %s", ifaceName)
+}
+
+// identityFromLinkLocal finds the Linode having the link-local address of
+// the identity-interface. Only the instances owning one of the IPv4
+// addresses of this host are checked, so the account isn't scanned.
+func identityFromLinkLocal(driver *linodeVolumeDriver, api *linodego.Client) (*instanceIdentity, error) {
+	linkLocal, err := resolveMachineLinkLocal()
+	if err != nil {
+		return nil, err
+	}
+
+	hostIPs, err := localAddresses(linodeIPv4)
+	if err != nil {
+		return nil, err
+	}
+	if len(hostIPs) == 0 {
+		return nil, fmt.Errorf("no IPv4 address found to narrow down instances: %w", errIdentitySourceSkipped)
+	}
+
+	instances, err := listInstancesByIPv4(api, hostIPs, driver.region())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, instance := range instances {
+		ips, err := api.GetInstanceIPAddresses(context.Background(), instance.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get ip addresses for instance %d: %s", instance.ID, err)
+		}
+
+		if ips.IPv6 == nil || ips.IPv6.LinkLocal == nil || ips.IPv6.LinkLocal.Address != linkLocal {
+			continue
+		}
+
+		return &instanceIdentity{id: instance.ID, region: instance.Region, label: instance.Label}, nil
+	}
+
+	return nil, fmt.Errorf("instance with link local address %s not found", linkLocal)
+}
+
+// identityFromLabel finds the Linode by the linode-label setting
+func identityFromLabel(driver *linodeVolumeDriver, api *linodego.Client) (*instanceIdentity, error) {
+	if driver.linodeLabel == "" {
+		return nil, fmt.Errorf("linode-label is not set: %w", errIdentitySourceSkipped)
+	}
+
+	jsonFilter, _ := json.Marshal(map[string]string{"label": driver.linodeLabel})
+	listOpts := linodego.NewListOptions(0, string(jsonFilter))
+	linodes, lErr := api.ListInstances(context.Background(), listOpts)
+
+	if lErr != nil {
+		return nil, fmt.Errorf("Could not determine Linode instance ID from Linode label %s due to error: %s", driver.linodeLabel, lErr)
+	} else if len(linodes) != 1 {
+		return nil, fmt.Errorf("Could not determine Linode instance ID from Linode label %s", driver.linodeLabel)
+	}
+
+	return &instanceIdentity{id: linodes[0].ID, region: linodes[0].Region, label: linodes[0].Label}, nil
+}
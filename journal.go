@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Operations recorded in the journal
+const (
+	opCreate  = "create"
+	opMount   = "mount"
+	opUnmount = "unmount"
+	opRemove  = "remove"
+)
+
+// Steps recorded for journaled operations
+const (
+	stepCreated    = "created"
+	stepAttached   = "attached"
+	stepFormatting = "formatting"
+	stepFormatted  = "formatted"
+	stepMkdir      = "mkdir"
+	stepMounted    = "mounted"
+	stepUnmounted  = "unmounted"
+	stepDetached   = "detached"
+)
+
+const journalSuffix = ".journal"
+
+// journalEntry records the intent and progress of a multi-step operation
+type journalEntry struct {
+	ID       string    `json:"id"`
+	Op       string    `json:"op"`
+	Volume   string    `json:"volume"`
+	VolumeID int       `json:"volume_id,omitempty"`
+	Steps    []string  `json:"steps"`
+	Started  time.Time `json:"started"`
+}
+
+// done returns whether step was recorded for the entry
+func (e *journalEntry) done(step string) bool {
+	return hasTag(e.Steps, step)
+}
+
+// journal is a write-ahead log of in-flight operations. Every entry is a
+// file in dir that is removed once its operation has finished, so entries
+// found at startup belong to operations interrupted by a crash.
+type journal struct {
+	dir   string
+	mutex sync.Mutex
+	seq   int
+}
+
+func newJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory %s: %s", dir, err)
+	}
+	return &journal{dir: dir}, nil
+}
+
+// begin records the intent to run op on a volume
+func (j *journal) begin(op, volumeLabel string) *journalEntry {
+	j.mutex.Lock()
+	j.seq++
+	id := fmt.Sprintf("%d-%d-%s-%s", time.Now().UnixNano(), j.seq, op, volumeLabel)
+	j.mutex.Unlock()
+
+	e := &journalEntry{ID: id, Op: op, Volume: volumeLabel, Steps: []string{}, Started: time.Now()}
+	j.write(e)
+	return e
+}
+
+// setVolumeID records the ID of the volume the operation works on
+func (j *journal) setVolumeID(e *journalEntry, volumeID int) {
+	e.VolumeID = volumeID
+	j.write(e)
+}
+
+// step records that step of the operation completed
+func (j *journal) step(e *journalEntry, step string) {
+	e.Steps = append(e.Steps, step)
+	j.write(e)
+}
+
+// finish removes the entry of a completed (or rolled back) operation
+func (j *journal) finish(e *journalEntry) {
+	if err := os.Remove(j.path(e)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Failed to remove journal entry %s: %s", e.ID, err)
+	}
+}
+
+// pending returns the entries of interrupted operations, oldest first
+func (j *journal) pending() ([]*journalEntry, error) {
+	files, err := filepath.Glob(filepath.Join(j.dir, "*"+journalSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*journalEntry
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		e := &journalEntry{}
+		if err := json.Unmarshal(b, e); err != nil {
+			log.Errorf("Discarding corrupt journal entry %s: %s", file, err)
+			os.Remove(file)
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, k int) bool { return entries[i].Started.Before(entries[k].Started) })
+	return entries, nil
+}
+
+func (j *journal) path(e *journalEntry) string {
+	name := strings.ReplaceAll(e.ID, string(filepath.Separator), "_")
+	return filepath.Join(j.dir, name+journalSuffix)
+}
+
+// write atomically replaces the entry file. Failing to journal does not fail
+// the operation, it only loses crash recovery for it.
+func (j *journal) write(e *journalEntry) {
+	if err := writeFileAtomic(j.path(e), e); err != nil {
+		log.Errorf("Failed to write journal entry %s: %s", e.ID, err)
+	}
+}
+
+// writeFileAtomic writes v as JSON to path through a synced temporary file
+func writeFileAtomic(path string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp." + strconv.Itoa(os.Getpid())
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/sdk"
+	"github.com/docker/go-plugins-helpers/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+// Admin endpoints served on the plugin socket next to the volume API
+const (
+	cordonPath   = "/Linode.Cordon"
+	uncordonPath = "/Linode.Uncordon"
+	drainPath    = "/Linode.Drain"
+	metricsPath  = "/Linode.Metrics"
+	reloadPath   = "/Linode.ReloadConfig"
+)
+
+const cordonFile = "cordoned"
+
+var errShuttingDown = errors.New("docker-volume-linode is shutting down")
+
+// reloadResponse reports the settings changed by a reload
+type reloadResponse struct {
+	Changed []string
+}
+
+// metricsResponse reports the internal state of the plugin
+type metricsResponse struct {
+	Attach attachMetrics
+}
+
+// drainResponse reports the result of a drain
+type drainResponse struct {
+	Detached []string
+	Busy     map[string]string
+	Errors   map[string]string
+}
+
+// track registers an in-flight operation. The returned function must be
+// called once the operation has finished.
+func (driver *linodeVolumeDriver) track() (func(), error) {
+	driver.lifecycleMutex.Lock()
+	defer driver.lifecycleMutex.Unlock()
+
+	if driver.stopping {
+		return nil, errShuttingDown
+	}
+
+	driver.inflight.Add(1)
+	return driver.inflight.Done, nil
+}
+
+// shutdown refuses new operations and waits up to timeout for the in-flight
+// ones. Operations still running afterwards are recovered from the journal
+// on the next start.
+func (driver *linodeVolumeDriver) shutdown(timeout time.Duration) {
+	driver.lifecycleMutex.Lock()
+	driver.stopping = true
+	driver.lifecycleMutex.Unlock()
+
+	// idle volumes are not kept attached across restarts
+	driver.flushDetaches()
+
+	done := make(chan struct{})
+	go func() {
+		driver.inflight.Wait()
+		close(done)
+	}()
+
+	log.Infof("Waiting up to %s for in-flight operations", timeout)
+	select {
+	case <-done:
+		log.Info("All in-flight operations finished")
+	case <-time.After(timeout):
+		log.Warn("Timed out waiting for in-flight operations, they will be recovered on the next start")
+	}
+}
+
+// isCordoned returns whether new mounts are refused on this node
+func (driver *linodeVolumeDriver) isCordoned() bool {
+	driver.lifecycleMutex.Lock()
+	defer driver.lifecycleMutex.Unlock()
+
+	return driver.cordoned
+}
+
+// setCordoned changes and persists the cordon state of this node
+func (driver *linodeVolumeDriver) setCordoned(cordoned bool) error {
+	driver.lifecycleMutex.Lock()
+	defer driver.lifecycleMutex.Unlock()
+
+	file := path.Join(driver.stateDir, cordonFile)
+	if cordoned {
+		if err := os.WriteFile(file, nil, 0o600); err != nil {
+			return fmt.Errorf("failed to persist cordon state: %s", err)
+		}
+		log.Warn("Node cordoned, new mounts will be refused")
+	} else {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to persist cordon state: %s", err)
+		}
+		log.Info("Node uncordoned")
+	}
+
+	driver.cordoned = cordoned
+	return nil
+}
+
+// loadCordoned restores the cordon state persisted by setCordoned
+func (driver *linodeVolumeDriver) loadCordoned() {
+	if _, err := os.Stat(path.Join(driver.stateDir, cordonFile)); err == nil {
+		log.Warn("Node is cordoned, new mounts will be refused")
+		driver.cordoned = true
+	}
+}
+
+// drain cordons this node, then detaches the volumes attached to it that are
+// not mounted, so they can be mounted on other nodes. Mounted volumes are
+// in use by a container as Docker unmounts them once no container uses them,
+// so they are only reported. As for eviction, volumes the plugin never
+// mounted may be in use by the host and are left alone.
+func (driver *linodeVolumeDriver) drain() (*drainResponse, error) {
+	log.Info("Draining node")
+
+	done, err := driver.track()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	if err := driver.setCordoned(true); err != nil {
+		return nil, err
+	}
+
+	api, err := driver.linodeAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	linVols, err := api.ListInstanceVolumes(context.Background(), driver.instanceID(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes attached to linode %d: %s", driver.instanceID(), err)
+	}
+
+	resp := &drainResponse{Busy: map[string]string{}, Errors: map[string]string{}}
+	guard := driver.volumeGuard()
+	for _, linVol := range linVols {
+		if !guard.allows(&linVol) {
+			continue
+		}
+
+		if !hasTagPrefix(linVol.Tags, fsUUIDTagPrefix) && !driver.hasPendingDetach(linVol.ID) {
+			continue
+		}
+
+		// the node was cordoned before this Mount started
+		if driver.isMounting(linVol.ID) {
+			resp.Busy[linVol.Label] = "being mounted"
+			continue
+		}
+
+		mp := driver.labelToMountPoint(linVol.Label)
+		mounted, err := isMounted(mp)
+		if err != nil {
+			resp.Errors[linVol.Label] = err.Error()
+			continue
+		}
+
+		if mounted {
+			busy := "mounted"
+			if holders := findMountHolders(mp); len(holders) > 0 {
+				busy = describeMountHolders(holders)
+			}
+			log.Infof("Drain: volume %s is in use by %s", linVol.Label, busy)
+			resp.Busy[linVol.Label] = busy
+			continue
+		}
+
+		pending := driver.cancelDetach(linVol.ID)
+		if err := driver.detachVolume(api, &linVol); err != nil {
+			log.Errorf("Drain: failed to release volume %s: %s", linVol.Label, err)
+			resp.Errors[linVol.Label] = err.Error()
+			if pending {
+				driver.scheduleDetach(&linVol, driver.volumeDetachDelay(&linVol))
+			}
+			continue
+		}
+		resp.Detached = append(resp.Detached, linVol.Label)
+	}
+
+	log.Infof("Drain finished: %d detached, %d busy, %d failed", len(resp.Detached), len(resp.Busy), len(resp.Errors))
+	return resp, nil
+}
+
+// registerAdminHandlers adds the cordon, uncordon, drain, metrics and reload
+// endpoints to the plugin socket
+func registerAdminHandlers(handler *volume.Handler, driver *linodeVolumeDriver, loader *configLoader) {
+	handler.HandleFunc(cordonPath, func(w http.ResponseWriter, r *http.Request) {
+		if err := driver.setCordoned(true); err != nil {
+			sdk.EncodeResponse(w, volume.NewErrorResponse(secrets.redact(err.Error())), true)
+			return
+		}
+		sdk.EncodeResponse(w, struct{}{}, false)
+	})
+	handler.HandleFunc(uncordonPath, func(w http.ResponseWriter, r *http.Request) {
+		if err := driver.setCordoned(false); err != nil {
+			sdk.EncodeResponse(w, volume.NewErrorResponse(secrets.redact(err.Error())), true)
+			return
+		}
+		sdk.EncodeResponse(w, struct{}{}, false)
+	})
+	handler.HandleFunc(drainPath, func(w http.ResponseWriter, r *http.Request) {
+		resp, err := driver.drain()
+		if err != nil {
+			sdk.EncodeResponse(w, volume.NewErrorResponse(secrets.redact(err.Error())), true)
+			return
+		}
+		sdk.EncodeResponse(w, resp, false)
+	})
+	handler.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		sdk.EncodeResponse(w, metricsResponse{Attach: driver.attaches.snapshot()}, false)
+	})
+	handler.HandleFunc(reloadPath, func(w http.ResponseWriter, r *http.Request) {
+		changed, err := driver.reloadConfig(loader)
+		if err != nil {
+			sdk.EncodeResponse(w, volume.NewErrorResponse(secrets.redact(err.Error())), true)
+			return
+		}
+		sdk.EncodeResponse(w, reloadResponse{Changed: changed}, false)
+	})
+}
@@ -1,89 +1,131 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"os/user"
+	"path"
 	"strconv"
-	"strings"
+	"syscall"
+	"time"
 
+	"github.com/docker/go-connections/sockets"
 	"github.com/docker/go-plugins-helpers/volume"
 	log "github.com/sirupsen/logrus"
 )
 
+// pluginSockDir is where docker looks for plugin sockets
+const pluginSockDir = "/run/docker/plugins"
+
+// pluginConfigFile is where the managed plugin mounts its config file, see
+// the config mount in config.json
+const pluginConfigFile = "/etc/docker-volume-linode/config.yaml"
+
 // VERSION set by --ldflags "-X main.VERSION=$VERSION"
 var VERSION string
 
-var (
-	forceAttach = cfgBool("force-attach", false, "If true, volumes will be forcibly attached to the current Linode if already attached to another Linode.")
-	mountRoot   = cfgString("mount-root", "/mnt", "The location to mount volumes to.")
-	socketUser  = cfgString("socket-user", "root", "Sets the user to create the socket with.")
-	logLevel    = cfgString("log-level", "info", "Sets log level: debug,info,warn,error")
-	linodeToken = cfgString("linode-token", "", "Required Personal Access Token generated in Linode Console.")
-	linodeLabel = cfgString("linode-label", "", "Sets the Linode Instance Label (defaults to the OS HOSTNAME)")
-)
-
 func main() {
+	configFlags := registerConfigFlags(flag.CommandLine)
+	configFile := flag.String("config-file", "", "Path of a YAML or TOML file to read settings from")
+	printConfig := flag.Bool("print-config", false, "Print the effective configuration with secrets redacted and exit")
+	generatePluginEnv := flag.String("generate-plugin-env", "", "Rewrite the env section of the given plugin config.json from the settings and exit")
 	flag.Parse()
 
+	if *generatePluginEnv != "" {
+		if err := writePluginEnv(*generatePluginEnv); err != nil {
+			log.Fatalf("failed to generate plugin env: %s", err)
+		}
+		return
+	}
+
+	if *configFile == "" {
+		*configFile, _ = getEnv("config-file")
+	}
+	loader := &configLoader{file: *configFile, fs: flag.CommandLine, flags: configFlags}
+	c, err := loader.load()
+	err = errors.Join(err, c.validate())
+
+	if *printConfig {
+		c.print(os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.SetOutput(os.Stdout)
-	level, err := log.ParseLevel(*logLevel)
+	log.SetFormatter(redactingFormatter{&log.TextFormatter{}})
+	secrets.add(c.LinodeToken)
+	registerProxySecret(c.APIProxy)
 	if err != nil {
-		level = log.InfoLevel
+		log.Fatalf("invalid configuration:\n%s", err)
 	}
-	log.SetLevel(level)
+	applyConfig(c)
 
 	log.Infof("docker-volume-linode/%s", VERSION)
 
-	// check required parameters (token and label)
-	if *linodeToken == "" {
-		log.Fatal("linode-token is required.")
+	token := c.LinodeToken
+	if c.LinodeTokenFile != "" {
+		if token, err = readTokenFile(c.LinodeTokenFile); err != nil {
+			log.Fatal(err)
+		}
+		secrets.add(token)
 	}
 
-	log.Debugf("linode-token: %s", *linodeToken)
-	log.Debugf("linode-label: %s", *linodeLabel)
-
-	driver := newLinodeVolumeDriver(*linodeLabel, *linodeToken, *mountRoot)
-	handler := volume.NewHandler(&driver)
-	log.Debug("connecting to socket ", *socketUser)
-	u, _ := user.Lookup(*socketUser)
-	gid, _ := strconv.Atoi(u.Gid)
-	log.Println(handler.ServeUnix("linode", gid))
-	//if serr != nil {
-	//	log.Errorf("failed to bind to the Unix socket: %v", serr)
-	//	os.Exit(1)
-	//}
-}
+	log.Debugf("linode-label: %s", c.LinodeLabel)
 
-func cfgString(name string, def string, desc string) *string {
-	newDef := def
-	if val, found := getEnv(name); found {
-		newDef = val
+	driver := newLinodeVolumeDriver(c.LinodeLabel, token, c.MountRoot, c.StateDir)
+	if c.LinodeTokenFile != "" {
+		go driver.watchTokenFile(c.LinodeTokenFile)
 	}
-	return flag.String(name, newDef, desc)
-}
+	handler := volume.NewHandler(redactingDriver{driver})
+	registerAdminHandlers(handler, driver, loader)
+	log.Debug("connecting to socket ", c.SocketUser)
+	u, _ := user.Lookup(c.SocketUser)
+	gid, _ := strconv.Atoi(u.Gid)
 
-func cfgBool(name string, def bool, desc string) bool {
-	val, found := getEnv(name)
-	if !found {
-		return false
+	if err := os.MkdirAll(pluginSockDir, 0o755); err != nil {
+		log.Fatalf("failed to create plugin socket directory: %v", err)
 	}
-
-	valNormalized := strings.ToLower(val)
-	return valNormalized == "true" || valNormalized == "1"
-}
-
-func getEnv(name string) (string, bool) {
-	if val, found := os.LookupEnv(name); found {
-		return val, true
+	socketPath := path.Join(pluginSockDir, "linode.sock")
+	listener, err := sockets.NewUnixSocket(socketPath, gid)
+	if err != nil {
+		log.Fatalf("failed to bind to the Unix socket: %v", err)
 	}
-
-	name = strings.ToUpper(name)
-	name = strings.ReplaceAll(name, "-", "_")
-
-	if val, found := os.LookupEnv(name); found {
-		return val, true
+	defer os.Remove(socketPath)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- handler.Serve(listener)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+serve:
+	for {
+		select {
+		case err := <-serveErr:
+			log.Errorf("plugin socket closed: %v", err)
+			break serve
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if _, err := driver.reloadConfig(loader); err != nil {
+					log.Errorf("Failed to reload configuration: %s", err)
+				}
+				continue
+			}
+
+			log.Infof("Received %s, shutting down", sig)
+			// stop accepting requests, those already accepted keep running
+			listener.Close()
+			break serve
+		}
 	}
 
-	return "", false
+	driver.shutdown(time.Duration(config().ShutdownTimeout) * time.Second)
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const selfMountInfo = "/proc/self/mountinfo"
+
+// mountInfo is a single entry of /proc/<pid>/mountinfo
+type mountInfo struct {
+	ID         int
+	Parent     int
+	MajorMinor string
+	Root       string
+	Mountpoint string
+	Options    string
+	FSType     string
+	Source     string
+}
+
+// readMountInfo parses the mountinfo file at path
+func readMountInfo(path string) ([]mountInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseMountInfo(f)
+}
+
+// parseMountInfo parses lines of the form
+// "36 35 98:0 /mnt1 /mnt/parent rw,noatime master:1 - ext3 /dev/root rw"
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		// optional fields end with a single "-"
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || len(fields) < sep+3 {
+			return nil, fmt.Errorf("malformed mountinfo line: %q", scanner.Text())
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed mountinfo line: %q", scanner.Text())
+		}
+		parent, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed mountinfo line: %q", scanner.Text())
+		}
+
+		mounts = append(mounts, mountInfo{
+			ID:         id,
+			Parent:     parent,
+			MajorMinor: fields[2],
+			Root:       unescapeMountInfo(fields[3]),
+			Mountpoint: unescapeMountInfo(fields[4]),
+			Options:    fields[5],
+			FSType:     fields[sep+1],
+			Source:     unescapeMountInfo(fields[sep+2]),
+		})
+	}
+
+	return mounts, scanner.Err()
+}
+
+// unescapeMountInfo decodes the octal escapes (\040 etc.) used for spaces,
+// tabs, newlines and backslashes in mountinfo paths
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// findMount returns the topmost mount on mountpoint, or nil if nothing is
+// mounted there
+func findMount(mountpoint string) (*mountInfo, error) {
+	mounts, err := readMountInfo(selfMountInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	mountpoint = filepath.Clean(mountpoint)
+
+	var found *mountInfo
+	for i := range mounts {
+		if mounts[i].Mountpoint == mountpoint {
+			found = &mounts[i]
+		}
+	}
+	return found, nil
+}
+
+// isMounted returns whether anything is mounted on mountpoint
+func isMounted(mountpoint string) (bool, error) {
+	m, err := findMount(mountpoint)
+	return m != nil, err
+}
+
+// deviceMajorMinor returns the "major:minor" number of a block device as
+// found in mountinfo
+func deviceMajorMinor(device string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(device, &st); err != nil {
+		return "", err
+	}
+
+	dev := uint64(st.Rdev)
+	return fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev)), nil
+}
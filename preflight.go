@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/linode/linodego/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// requiredScope is an OAuth scope the plugin needs and what for
+type requiredScope struct {
+	scope string
+	level linodego.GrantPermissionLevel
+	usage string
+}
+
+var requiredScopes = []requiredScope{
+	{"volumes", linodego.AccessLevelReadWrite, "create, attach, detach, tag and delete volumes"},
+	{"linodes", linodego.AccessLevelReadWrite, "attach volumes to the current Linode"},
+	{"events", linodego.AccessLevelReadOnly, "wait for volume operations without polling"},
+}
+
+// parseScopes parses the X-OAuth-Scopes header, e.g.
+// "linodes:read_only volumes:read_write" or "*"
+func parseScopes(header string) map[string]linodego.GrantPermissionLevel {
+	scopes := map[string]linodego.GrantPermissionLevel{}
+	for _, s := range strings.Fields(strings.ReplaceAll(header, ",", " ")) {
+		if s == "*" {
+			for _, r := range requiredScopes {
+				scopes[r.scope] = linodego.AccessLevelReadWrite
+			}
+			continue
+		}
+		if name, level, ok := strings.Cut(s, ":"); ok {
+			scopes[name] = linodego.GrantPermissionLevel(level)
+		}
+	}
+	return scopes
+}
+
+// grants returns whether have is at least need
+func grants(have, need linodego.GrantPermissionLevel) bool {
+	return have == linodego.AccessLevelReadWrite || (have == linodego.AccessLevelReadOnly && need == linodego.AccessLevelReadOnly)
+}
+
+// checkTokenPermissions reports every scope and grant the token lacks for
+// the operations of the plugin
+func (driver *linodeVolumeDriver) checkTokenPermissions(api *linodego.Client) ([]string, error) {
+	resp, err := api.R(context.Background()).Get("profile")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token scopes: %s", err)
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("failed to read token scopes: %s", resp.Status())
+	}
+
+	var missing []string
+	if header := resp.Header().Get("X-OAuth-Scopes"); header == "" {
+		log.Warn("The Linode API did not report the scopes of the token, skipping the scope check")
+	} else {
+		scopes := parseScopes(header)
+		for _, r := range requiredScopes {
+			have, ok := scopes[r.scope]
+			if !ok {
+				have = "none"
+			}
+			if !grants(have, r.level) {
+				missing = append(missing, fmt.Sprintf("token scope %s:%s is needed to %s (token has %s)", r.scope, r.level, r.usage, have))
+			}
+		}
+	}
+
+	profile, err := api.GetProfile(context.Background())
+	if err != nil {
+		return missing, fmt.Errorf("failed to read profile: %s", err)
+	}
+	if !profile.Restricted {
+		return missing, nil
+	}
+
+	g, err := api.GrantsList(context.Background())
+	if err != nil {
+		return missing, fmt.Errorf("failed to read grants of restricted user %s: %s", profile.Username, err)
+	}
+
+	if !g.Global.AddVolumes {
+		missing = append(missing, fmt.Sprintf("user %s needs the add_volumes grant to create volumes", profile.Username))
+	}
+
+	instanceGrant := linodego.GrantPermissionLevel("none")
+	for _, e := range g.Linode {
+		if e.ID == driver.instanceID() {
+			instanceGrant = e.Permissions
+		}
+	}
+	if driver.instanceID() != 0 && !grants(instanceGrant, linodego.AccessLevelReadWrite) {
+		missing = append(missing, fmt.Sprintf("user %s needs read_write on linode %d to attach volumes to it (has %s)",
+			profile.Username, driver.instanceID(), instanceGrant))
+	}
+
+	readOnly, err := driver.readOnlyVolumes(api, g.Volume)
+	if err != nil {
+		return missing, err
+	}
+	if len(readOnly) > 0 {
+		missing = append(missing, fmt.Sprintf("user %s needs read_write on volumes %s to attach them",
+			profile.Username, strings.Join(readOnly, ", ")))
+	}
+
+	return missing, nil
+}
+
+// preflightToken logs what the token is missing. In strict mode a missing
+// permission, or failing to check them, is an error.
+func (driver *linodeVolumeDriver) preflightToken(api *linodego.Client, strict bool) error {
+	missing, err := driver.checkTokenPermissions(api)
+	if err != nil {
+		if strict {
+			return err
+		}
+		log.Warnf("Could not check the permissions of the Linode token: %s", err)
+	}
+
+	if len(missing) == 0 {
+		if err == nil {
+			log.Info("Linode token has every permission the plugin needs")
+		}
+		return nil
+	}
+
+	for _, m := range missing {
+		log.Errorf("Linode token is missing a permission: %s", m)
+	}
+	if strict {
+		return errors.New("the Linode token is missing permissions, see the log for details")
+	}
+	return nil
+}
+
+// readOnlyVolumes returns the labels of the volumes granted without
+// read_write among those the plugin manages: volumes in the region of this
+// node that the volume guard allows
+func (driver *linodeVolumeDriver) readOnlyVolumes(api *linodego.Client, volumeGrants []linodego.GrantedEntity) ([]string, error) {
+	var ids []int
+	for _, e := range volumeGrants {
+		if !grants(e.Permissions, linodego.AccessLevelReadWrite) {
+			ids = append(ids, e.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	filter := linodego.Filter{}
+	if region := driver.region(); region != "" {
+		filter.AddField(linodego.Eq, "region", region)
+	}
+	filterStr, err := filter.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	linVols, err := api.ListVolumes(context.Background(), linodego.NewListOptions(0, string(filterStr)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %s", err)
+	}
+
+	managed := make(map[int]string)
+	guard := driver.volumeGuard()
+	for _, linVol := range linVols {
+		if guard.allows(&linVol) {
+			managed[linVol.ID] = linVol.Label
+		}
+	}
+
+	var labels []string
+	for _, id := range ids {
+		if label, ok := managed[id]; ok {
+			labels = append(labels, label)
+		}
+	}
+	return labels, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ProbeResult describes the signatures found on a block device. Type holds
+// the filesystem (or other content) type and PTType the partition table
+// type, matching the blkid TYPE and PTTYPE values. UUID is the one of the
+// filesystem, PTUUID the one of the partition table.
+type ProbeResult struct {
+	Type   string
+	UUID   string
+	Label  string
+	PTType string
+	PTUUID string
+}
+
+// Empty returns whether no signature was found
+func (p ProbeResult) Empty() bool {
+	return p.Type == "" && p.PTType == ""
+}
+
+type superblockProber func(r io.ReaderAt) (ProbeResult, bool)
+
+// superblockProbers are tried in order; content signatures come before
+// partition tables as a filesystem boot sector may look like an MBR
+var superblockProbers = []superblockProber{
+	probeLUKS,
+	probeXFS,
+	probeExt,
+	probeBtrfs,
+	probeSwap,
+	probeGPT,
+	probeMBR,
+}
+
+// ProbeDevice reads the superblocks of a block device, falling back to
+// blkid for content the native probers don't know about.
+func ProbeDevice(device string) (ProbeResult, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return ProbeResult{}, err
+	}
+	defer f.Close()
+
+	result := ProbeReader(f)
+	if !result.Empty() {
+		return result, nil
+	}
+
+	return probeBlkid(device)
+}
+
+// ProbeReader runs the native superblock probers against r
+func ProbeReader(r io.ReaderAt) ProbeResult {
+	for _, probe := range superblockProbers {
+		if result, ok := probe(r); ok {
+			return result
+		}
+	}
+	return ProbeResult{}
+}
+
+// probeBlkid parses the output of "blkid -o export"
+func probeBlkid(device string) (ProbeResult, error) {
+	if _, err := exec.LookPath("blkid"); err != nil {
+		return ProbeResult{}, nil
+	}
+
+	out, err := exec.Command("blkid", "-p", "-o", "export", device).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		// exit status 2 means nothing was found
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+			return ProbeResult{}, nil
+		}
+		return ProbeResult{}, err
+	}
+
+	return parseBlkidExport(out), nil
+}
+
+func parseBlkidExport(out []byte) ProbeResult {
+	result := ProbeResult{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found {
+			continue
+		}
+		value = unescapeBlkidValue(value)
+		switch key {
+		case "TYPE":
+			result.Type = value
+		case "UUID":
+			result.UUID = value
+		case "LABEL":
+			result.Label = value
+		case "PTTYPE":
+			result.PTType = value
+		case "PTUUID":
+			result.PTUUID = value
+		}
+	}
+	return result
+}
+
+// unescapeBlkidValue removes the backslashes blkid escapes spaces and shell
+// characters of export values with, e.g. "my\ data"
+func unescapeBlkidValue(value string) string {
+	var b strings.Builder
+	escaped := false
+	for _, c := range value {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func readAt(r io.ReaderAt, off int64, size int) ([]byte, bool) {
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil, false
+	}
+	return buf, true
+}
+
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	if len(s) != 32 {
+		return s
+	}
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+const (
+	extSuperblockOffset = 1024
+
+	extCompatHasJournal = 0x4
+
+	extIncompatExtents = 0x40
+	extIncompat64Bit   = 0x80
+	extIncompatMMP     = 0x100
+	extIncompatFlexBG  = 0x200
+
+	extROCompatHugeFile     = 0x8
+	extROCompatGDTCsum      = 0x10
+	extROCompatDirNlink     = 0x20
+	extROCompatExtraIsize   = 0x40
+	extROCompatMetadataCsum = 0x400
+)
+
+func probeExt(r io.ReaderAt) (ProbeResult, bool) {
+	sb, ok := readAt(r, extSuperblockOffset, 136)
+	if !ok || binary.LittleEndian.Uint16(sb[56:58]) != 0xEF53 {
+		return ProbeResult{}, false
+	}
+
+	compat := binary.LittleEndian.Uint32(sb[92:96])
+	incompat := binary.LittleEndian.Uint32(sb[96:100])
+	roCompat := binary.LittleEndian.Uint32(sb[100:104])
+
+	fsType := "ext2"
+	if incompat&(extIncompatExtents|extIncompat64Bit|extIncompatMMP|extIncompatFlexBG) != 0 ||
+		roCompat&(extROCompatHugeFile|extROCompatGDTCsum|extROCompatDirNlink|
+			extROCompatExtraIsize|extROCompatMetadataCsum) != 0 {
+		fsType = "ext4"
+	} else if compat&extCompatHasJournal != 0 {
+		fsType = "ext3"
+	}
+
+	return ProbeResult{
+		Type:  fsType,
+		UUID:  formatUUID(sb[104:120]),
+		Label: cString(sb[120:136]),
+	}, true
+}
+
+func probeXFS(r io.ReaderAt) (ProbeResult, bool) {
+	sb, ok := readAt(r, 0, 120)
+	if !ok || string(sb[0:4]) != "XFSB" {
+		return ProbeResult{}, false
+	}
+
+	return ProbeResult{
+		Type:  "xfs",
+		UUID:  formatUUID(sb[32:48]),
+		Label: cString(sb[108:120]),
+	}, true
+}
+
+const btrfsSuperblockOffset = 0x10000
+
+func probeBtrfs(r io.ReaderAt) (ProbeResult, bool) {
+	sb, ok := readAt(r, btrfsSuperblockOffset, 0x22b)
+	if !ok || string(sb[0x40:0x48]) != "_BHRfS_M" {
+		return ProbeResult{}, false
+	}
+
+	return ProbeResult{
+		Type:  "btrfs",
+		UUID:  formatUUID(sb[0x20:0x30]),
+		Label: cString(sb[0x12b:0x22b]),
+	}, true
+}
+
+func probeLUKS(r io.ReaderAt) (ProbeResult, bool) {
+	hdr, ok := readAt(r, 0, 208)
+	if !ok || string(hdr[0:6]) != "LUKS\xba\xbe" {
+		return ProbeResult{}, false
+	}
+
+	result := ProbeResult{
+		Type: "crypto_LUKS",
+		UUID: cString(hdr[168:208]),
+	}
+	// only LUKS2 headers carry a label
+	if binary.BigEndian.Uint16(hdr[6:8]) == 2 {
+		result.Label = cString(hdr[24:72])
+	}
+	return result, true
+}
+
+// swapPageSizes are the page sizes the swap signature may be found for
+var swapPageSizes = []int64{4096, 8192, 16384, 65536}
+
+func probeSwap(r io.ReaderAt) (ProbeResult, bool) {
+	for _, pageSize := range swapPageSizes {
+		magic, ok := readAt(r, pageSize-10, 10)
+		if !ok {
+			return ProbeResult{}, false
+		}
+
+		switch string(magic) {
+		case "SWAPSPACE2":
+			hdr, ok := readAt(r, 1024, 44)
+			if !ok {
+				return ProbeResult{}, false
+			}
+			return ProbeResult{
+				Type:  "swap",
+				UUID:  formatUUID(hdr[12:28]),
+				Label: cString(hdr[28:44]),
+			}, true
+		case "SWAP-SPACE":
+			return ProbeResult{Type: "swap"}, true
+		}
+	}
+	return ProbeResult{}, false
+}
+
+func probeGPT(r io.ReaderAt) (ProbeResult, bool) {
+	hdr, ok := readAt(r, 512, 72)
+	if !ok || string(hdr[0:8]) != "EFI PART" {
+		return ProbeResult{}, false
+	}
+
+	// the disk GUID is stored mixed-endian
+	guid := hdr[56:72]
+	uuid := make([]byte, 16)
+	binary.BigEndian.PutUint32(uuid[0:4], binary.LittleEndian.Uint32(guid[0:4]))
+	binary.BigEndian.PutUint16(uuid[4:6], binary.LittleEndian.Uint16(guid[4:6]))
+	binary.BigEndian.PutUint16(uuid[6:8], binary.LittleEndian.Uint16(guid[6:8]))
+	copy(uuid[8:], guid[8:])
+
+	return ProbeResult{PTType: "gpt", PTUUID: formatUUID(uuid)}, true
+}
+
+func probeMBR(r io.ReaderAt) (ProbeResult, bool) {
+	mbr, ok := readAt(r, 0, 512)
+	if !ok || mbr[510] != 0x55 || mbr[511] != 0xAA {
+		return ProbeResult{}, false
+	}
+
+	// four 16 byte partition entries start at 446, the type is at offset 4
+	for i := 0; i < 4; i++ {
+		entry := mbr[446+16*i : 446+16*(i+1)]
+		if entry[0] != 0x00 && entry[0] != 0x80 {
+			return ProbeResult{}, false
+		}
+		if entry[4] != 0 {
+			// blkid reports the disk signature at 440 as the UUID
+			signature := binary.LittleEndian.Uint32(mbr[440:444])
+			return ProbeResult{PTType: "dos", PTUUID: fmt.Sprintf("%08x", signature)}, true
+		}
+	}
+	return ProbeResult{}, false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fixtures in testdata/probe are the leading bytes of 1 MiB images,
+// gzipped. The ext and swap ones were created by mkfs/mkswap, the others
+// assembled by hand. blkid checks signatures against the device size, so it
+// only recognizes them with the same values once extended back to 1 MiB
+// (truncate -s 1M). The .blkid files are "blkid -p -o export" outputs of the
+// extended images.
+const (
+	fixtureUUID = "0f2c7d84-3b1e-4e9a-9a51-2f6d8c1b7e30"
+	fixtureLUKS = "9a8b7c6d-5e4f-4a3b-8c2d-1e0f9a8b7c6d"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join("testdata", "probe", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if filepath.Ext(name) != ".gz" {
+		b, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestProbeReader(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    ProbeResult
+	}{
+		{"ext2.img.gz", ProbeResult{Type: "ext2", UUID: fixtureUUID, Label: "my data"}},
+		// blkid reports SEC_TYPE=ext2 for ext3
+		{"ext3.img.gz", ProbeResult{Type: "ext3", UUID: fixtureUUID, Label: "my data"}},
+		{"ext4.img.gz", ProbeResult{Type: "ext4", UUID: fixtureUUID, Label: "my data"}},
+		{"xfs.img.gz", ProbeResult{Type: "xfs", UUID: "7b3a9c1e-2d4f-4a6b-8c5d-1e2f3a4b5c6d", Label: "my data"}},
+		{"btrfs.img.gz", ProbeResult{Type: "btrfs", UUID: "3c4d5e6f-7081-4293-a4b5-c6d7e8f90a1b", Label: "my data"}},
+		{"luks1.img.gz", ProbeResult{Type: "crypto_LUKS", UUID: fixtureLUKS}},
+		{"luks2.img.gz", ProbeResult{Type: "crypto_LUKS", UUID: fixtureLUKS, Label: "my data"}},
+		{"swap.img.gz", ProbeResult{Type: "swap", UUID: "5e1a2b3c-4d5e-4f60-8a7b-9c0d1e2f3a4b", Label: "swap space"}},
+		// partition tables only set PTTYPE and PTUUID
+		{"gpt.img.gz", ProbeResult{PTType: "gpt", PTUUID: "1a2b3c4d-5e6f-4708-9a1b-2c3d4e5f6071"}},
+		{"mbr.img.gz", ProbeResult{PTType: "dos", PTUUID: "1234abcd"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			got := ProbeReader(bytes.NewReader(readFixture(t, tt.fixture)))
+			if got != tt.want {
+				t.Errorf("ProbeReader() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeReaderBlank(t *testing.T) {
+	for _, size := range []int{0, 512, 4096, 1 << 17} {
+		if got := ProbeReader(bytes.NewReader(make([]byte, size))); !got.Empty() {
+			t.Errorf("ProbeReader() of %d zero bytes = %+v, want empty", size, got)
+		}
+	}
+}
+
+func TestParseBlkidExport(t *testing.T) {
+	tests := []struct {
+		name string
+		out  []byte
+		want ProbeResult
+	}{
+		{
+			name: "ext3 with SEC_TYPE and escaped label",
+			out:  readFixture(t, "ext3.blkid"),
+			want: ProbeResult{Type: "ext3", UUID: fixtureUUID, Label: "my data"},
+		},
+		{
+			name: "partition table",
+			out:  readFixture(t, "gpt.blkid"),
+			want: ProbeResult{PTType: "gpt", PTUUID: "1a2b3c4d-5e6f-4708-9a1b-2c3d4e5f6071"},
+		},
+		{
+			name: "filesystem with partition table",
+			out:  []byte("DEVNAME=/dev/sdb\nUUID=1234-ABCD\nTYPE=vfat\nPTTYPE=dos\nLABEL=a\\ b\\\\c\n"),
+			want: ProbeResult{Type: "vfat", UUID: "1234-ABCD", Label: `a b\c`, PTType: "dos"},
+		},
+		{
+			name: "nothing found",
+			out:  nil,
+			want: ProbeResult{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseBlkidExport(tt.out); got != tt.want {
+				t.Errorf("parseBlkidExport() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
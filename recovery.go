@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/linode/linodego/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// recoverJournal finishes operations that were interrupted by a crash.
+// Docker saw creates and mounts fail, so those are rolled back; unmounts
+// and removes are idempotent and resumed.
+func (driver *linodeVolumeDriver) recoverJournal() {
+	entries, err := driver.journal.pending()
+	if err != nil {
+		log.Errorf("Failed to read operation journal: %s", err)
+		return
+	}
+
+	for _, entry := range entries {
+		log.Warnf("Recovering interrupted %s of volume %s (completed steps: %s)",
+			entry.Op, entry.Volume, strings.Join(entry.Steps, ","))
+
+		var err error
+		switch entry.Op {
+		case opCreate:
+			err = driver.rollbackCreate(entry)
+		case opMount:
+			err = driver.rollbackMount(entry)
+		case opUnmount:
+			err = driver.Unmount(&volume.UnmountRequest{Name: entry.Volume})
+		case opRemove:
+			err = driver.Remove(&volume.RemoveRequest{Name: entry.Volume})
+		default:
+			log.Errorf("Unknown operation %q in journal entry %s", entry.Op, entry.ID)
+		}
+
+		if err != nil {
+			log.Errorf("Failed to recover %s of volume %s: %s", entry.Op, entry.Volume, err)
+		} else {
+			log.Infof("Recovered %s of volume %s", entry.Op, entry.Volume)
+		}
+
+		// Docker retries failed requests, so a failed recovery is not
+		// attempted again on the next start
+		driver.journal.finish(entry)
+	}
+}
+
+// rollbackCreate deletes a volume whose creation was interrupted, as long as
+// it was never used
+func (driver *linodeVolumeDriver) rollbackCreate(entry *journalEntry) error {
+	if !entry.done(stepCreated) {
+		return nil
+	}
+
+	api, err := driver.linodeAPI()
+	if err != nil {
+		return err
+	}
+
+	linVol, err := api.GetVolume(context.Background(), entry.VolumeID)
+	if linodego.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !hasTag(linVol.Tags, unformattedTag) || linVol.LinodeID != nil {
+		log.Warnf("Volume %s was used since its creation was interrupted, keeping it", entry.Volume)
+		return nil
+	}
+
+	log.Warnf("Deleting volume %d of interrupted create", entry.VolumeID)
+	return api.DeleteVolume(context.Background(), entry.VolumeID)
+}
+
+// rollbackMount undoes the completed steps of an interrupted mount
+func (driver *linodeVolumeDriver) rollbackMount(entry *journalEntry) error {
+	mp := driver.labelToMountPoint(volumeLabel(entry.Volume))
+
+	if entry.done(stepFormatting) && !entry.done(stepFormatted) {
+		log.Warnf("Format of volume %s was interrupted, it will be formatted again on the next mount", entry.Volume)
+	}
+
+	var errs []error
+
+	if entry.done(stepMounted) {
+		if err := Umount(mp); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if entry.done(stepMkdir) {
+		if err := os.Remove(mp); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	if entry.done(stepAttached) {
+		api, err := driver.linodeAPI()
+		if err != nil {
+			return err
+		}
+
+		linVol, err := api.GetVolume(context.Background(), entry.VolumeID)
+		if err != nil && !linodego.IsNotFound(err) {
+			errs = append(errs, err)
+		} else if err == nil && linVol.LinodeID != nil && *linVol.LinodeID == driver.instanceID() {
+			if err := driver.detachAndWait(api, entry.VolumeID); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "<redacted>"
+
+// secretSet holds the values that must never appear in logs or errors
+type secretSet struct {
+	mutex  sync.RWMutex
+	values []string
+}
+
+// secrets are redacted from every log line and error returned to Docker.
+// Rotated tokens are kept, as they may still show up in late responses.
+var secrets = &secretSet{}
+
+func (s *secretSet) add(value string) {
+	if value == "" {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, v := range s.values {
+		if v == value {
+			return
+		}
+	}
+	s.values = append(s.values, value)
+}
+
+// redact replaces every secret in text
+func (s *secretSet) redact(text string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, v := range s.values {
+		text = strings.ReplaceAll(text, v, redacted)
+	}
+	return text
+}
+
+// redactError returns err with every secret replaced in its message
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if msg := secrets.redact(err.Error()); msg != err.Error() {
+		return errors.New(msg)
+	}
+	return err
+}
+
+// redactingFormatter redacts secrets from the output of another formatter,
+// which covers linodego debug output too as it is logged through logrus
+type redactingFormatter struct {
+	log.Formatter
+}
+
+func (f redactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	b, err := f.Formatter.Format(entry)
+	return []byte(secrets.redact(string(b))), err
+}
+
+// redactingDriver redacts secrets from the errors a driver returns to Docker
+type redactingDriver struct {
+	driver volume.Driver
+}
+
+func (d redactingDriver) Create(req *volume.CreateRequest) error {
+	return redactError(d.driver.Create(req))
+}
+
+func (d redactingDriver) List() (*volume.ListResponse, error) {
+	resp, err := d.driver.List()
+	return resp, redactError(err)
+}
+
+func (d redactingDriver) Get(req *volume.GetRequest) (*volume.GetResponse, error) {
+	resp, err := d.driver.Get(req)
+	return resp, redactError(err)
+}
+
+func (d redactingDriver) Remove(req *volume.RemoveRequest) error {
+	return redactError(d.driver.Remove(req))
+}
+
+func (d redactingDriver) Path(req *volume.PathRequest) (*volume.PathResponse, error) {
+	resp, err := d.driver.Path(req)
+	return resp, redactError(err)
+}
+
+func (d redactingDriver) Mount(req *volume.MountRequest) (*volume.MountResponse, error) {
+	resp, err := d.driver.Mount(req)
+	return resp, redactError(err)
+}
+
+func (d redactingDriver) Unmount(req *volume.UnmountRequest) error {
+	return redactError(d.driver.Unmount(req))
+}
+
+func (d redactingDriver) Capabilities() *volume.CapabilitiesResponse {
+	return d.driver.Capabilities()
+}
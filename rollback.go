@@ -0,0 +1,47 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// rollback records how to undo the completed steps of a multi-step
+// operation. Unless committed, run undoes them in reverse order.
+type rollback struct {
+	op        string
+	steps     []rollbackStep
+	committed bool
+}
+
+type rollbackStep struct {
+	name string
+	undo func() error
+}
+
+func newRollback(op string) *rollback {
+	return &rollback{op: op}
+}
+
+// add records the undo action of a step that just completed
+func (rb *rollback) add(name string, undo func() error) {
+	rb.steps = append(rb.steps, rollbackStep{name: name, undo: undo})
+}
+
+// commit marks the operation as successful, so run does nothing
+func (rb *rollback) commit() {
+	rb.committed = true
+}
+
+// run undoes the recorded steps in reverse order, meant to be deferred
+func (rb *rollback) run() {
+	if rb.committed {
+		return
+	}
+
+	for i := len(rb.steps) - 1; i >= 0; i-- {
+		step := rb.steps[i]
+		log.Warnf("%s failed, rolling back: %s", rb.op, step.name)
+		if err := step.undo(); err != nil {
+			log.Errorf("%s rollback of %s failed: %s", rb.op, step.name, err)
+		}
+	}
+}
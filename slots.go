@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/linode/linodego/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// smallInstanceVolumeSlots is the number of volumes instances with up to
+	// smallInstanceMemory MB of memory can attach
+	smallInstanceVolumeSlots = 8
+	smallInstanceMemory      = 16384
+
+	// maxInstanceVolumeSlots caps the one slot per GB of larger instances
+	maxInstanceVolumeSlots = 64
+)
+
+// volumeSlots returns how many volumes this instance can attach, from the
+// volume-slots setting or the memory of the instance
+func (driver *linodeVolumeDriver) volumeSlots(api *linodego.Client) (int, error) {
+	if slots := config().VolumeSlots; slots > 0 {
+		return slots, nil
+	}
+
+	driver.slotsMutex.Lock()
+	defer driver.slotsMutex.Unlock()
+
+	if driver.instanceVolumeSlots > 0 {
+		return driver.instanceVolumeSlots, nil
+	}
+
+	instance, err := api.GetInstance(context.Background(), driver.instanceID())
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up volume slots of linode %d: %s", driver.instanceID(), err)
+	}
+
+	slots := smallInstanceVolumeSlots
+	if instance.Specs != nil && instance.Specs.Memory > smallInstanceMemory {
+		slots = instance.Specs.Memory / 1024
+		if slots > maxInstanceVolumeSlots {
+			slots = maxInstanceVolumeSlots
+		}
+	}
+
+	log.Infof("Linode %d can attach %d volumes", driver.instanceID(), slots)
+	driver.instanceVolumeSlots = slots
+	return slots, nil
+}
+
+// ensureVolumeSlot makes sure another volume can be attached to this
+// instance, detaching idle volumes if evict-idle-volumes is set. Attaches in
+// progress count as attached. attachSlotMutex must be held.
+func (driver *linodeVolumeDriver) ensureVolumeSlot(api *linodego.Client) error {
+	slots, err := driver.volumeSlots(api)
+	if err != nil {
+		return err
+	}
+
+	attached, err := api.ListInstanceVolumes(context.Background(), driver.instanceID(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to list volumes attached to linode %d: %s", driver.instanceID(), err)
+	}
+
+	used := len(attached)
+	for volumeID := range driver.slotReservations {
+		if !slices.ContainsFunc(attached, func(v linodego.Volume) bool { return v.ID == volumeID }) {
+			used++
+		}
+	}
+
+	if used < slots {
+		return nil
+	}
+
+	if config().EvictIdleVolumes {
+		if linVol := driver.findIdleVolume(attached); linVol != nil {
+			log.Warnf("%d/%d volume slots used, detaching idle volume %s", used, slots, linVol.Label)
+			driver.cancelDetach(linVol.ID)
+			if err := driver.detachVolume(api, linVol); err != nil {
+				return fmt.Errorf("failed to evict idle volume %s: %s", linVol.Label, err)
+			}
+			return nil
+		}
+	}
+
+	labels := make([]string, len(attached))
+	for i, linVol := range attached {
+		labels[i] = linVol.Label
+	}
+	if attaching := used - len(attached); attaching > 0 {
+		labels = append(labels, fmt.Sprintf("%d being attached", attaching))
+	}
+	return fmt.Errorf("%d/%d volume slots used: %s", used, slots, strings.Join(labels, ", "))
+}
+
+// checkVolumeSlot makes sure another volume can be attached to this instance
+func (driver *linodeVolumeDriver) checkVolumeSlot(api *linodego.Client) error {
+	driver.attachSlotMutex.Lock()
+	defer driver.attachSlotMutex.Unlock()
+
+	return driver.ensureVolumeSlot(api)
+}
+
+// attachToSlot reserves a volume slot, then attaches a volume to this
+// instance. Reserved slots count as used until the attach is over, so that
+// concurrent attaches can't both take the last free slot.
+func (driver *linodeVolumeDriver) attachToSlot(api *linodego.Client, volumeID int) error {
+	driver.attachSlotMutex.Lock()
+	if err := driver.ensureVolumeSlot(api); err != nil {
+		driver.attachSlotMutex.Unlock()
+		return err
+	}
+	driver.slotReservations[volumeID] = struct{}{}
+	driver.attachSlotMutex.Unlock()
+
+	defer func() {
+		driver.attachSlotMutex.Lock()
+		delete(driver.slotReservations, volumeID)
+		driver.attachSlotMutex.Unlock()
+	}()
+
+	return driver.attachAndWait(api, volumeID, driver.instanceID())
+}
+
+// beginMount records a Mount in progress for a volume, endMount must be
+// called once it is over
+func (driver *linodeVolumeDriver) beginMount(volumeID int) {
+	driver.slotsMutex.Lock()
+	defer driver.slotsMutex.Unlock()
+
+	driver.mounting[volumeID]++
+}
+
+func (driver *linodeVolumeDriver) endMount(volumeID int) {
+	driver.slotsMutex.Lock()
+	defer driver.slotsMutex.Unlock()
+
+	if driver.mounting[volumeID]--; driver.mounting[volumeID] <= 0 {
+		delete(driver.mounting, volumeID)
+	}
+}
+
+// isMounting returns whether a Mount of a volume is in progress
+func (driver *linodeVolumeDriver) isMounting(volumeID int) bool {
+	driver.slotsMutex.Lock()
+	defer driver.slotsMutex.Unlock()
+
+	return driver.mounting[volumeID] > 0
+}
+
+// findIdleVolume picks an attached volume to evict. Volumes waiting for their
+// detach delay come first, then other volumes the plugin mounted before that
+// are not mounted now. Volumes the plugin never mounted may be in use by the
+// host and are left alone, as are volumes a Mount is in progress for.
+func (driver *linodeVolumeDriver) findIdleVolume(attached []linodego.Volume) *linodego.Volume {
+	driver.detachMutex.Lock()
+	for i := range attached {
+		if _, ok := driver.pendingDetaches[attached[i].ID]; ok && !driver.isMounting(attached[i].ID) {
+			driver.detachMutex.Unlock()
+			return &attached[i]
+		}
+	}
+	driver.detachMutex.Unlock()
+
+	guard := driver.volumeGuard()
+	for i := range attached {
+		linVol := &attached[i]
+		if !hasTagPrefix(linVol.Tags, fsUUIDTagPrefix) || !guard.allows(linVol) || driver.isMounting(linVol.ID) {
+			continue
+		}
+
+		mounted, err := isMounted(driver.labelToMountPoint(linVol.Label))
+		if err != nil {
+			log.Warnf("Failed to check whether volume %s is mounted: %s", linVol.Label, err)
+			continue
+		}
+		if !mounted {
+			return linVol
+		}
+	}
+
+	return nil
+}
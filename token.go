@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tokenFilePollInterval is how often linode-token-file is checked for a
+// rotated token
+const tokenFilePollInterval = 30 * time.Second
+
+// readTokenFile reads a token from a file such as a Docker secret
+func readTokenFile(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read linode-token-file: %s", err)
+	}
+
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("linode-token-file %s is empty", file)
+	}
+	return token, nil
+}
+
+// watchTokenFile switches to the token in file whenever it changes
+func (driver *linodeVolumeDriver) watchTokenFile(file string) {
+	ticker := time.NewTicker(tokenFilePollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		token, err := readTokenFile(file)
+		if err != nil {
+			log.Warnf("Keeping the current Linode token: %s", err)
+			continue
+		}
+		if err := driver.setToken(token); err != nil {
+			log.Errorf("Failed to switch to the rotated Linode token: %s", err)
+		}
+	}
+}
+
+// setToken rebuilds the API client if token differs from the current one.
+// Requests already running finish with the previous client.
+func (driver *linodeVolumeDriver) setToken(token string) error {
+	secrets.add(token)
+
+	driver.apiMutex.Lock()
+	defer driver.apiMutex.Unlock()
+
+	if token == driver.linodeToken {
+		return nil
+	}
+
+	if driver.linodeAPIPtr != nil {
+		api, err := setupLinodeAPI(token)
+		if err != nil {
+			return err
+		}
+		driver.linodeAPIPtr = api
+	}
+	driver.linodeToken = token
+
+	log.Info("Switched to the rotated Linode token")
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// uevent is a kernel object event received over netlink
+type uevent struct {
+	Action    string
+	Subsystem string
+	DevName   string
+}
+
+// ueventMonitor listens for kernel uevents and fans them out to subscribers
+type ueventMonitor struct {
+	mutex       sync.Mutex
+	fd          int
+	started     bool
+	err         error
+	subscribers map[chan uevent]struct{}
+}
+
+var blockDeviceEvents = &ueventMonitor{subscribers: make(map[chan uevent]struct{})}
+
+// subscribe returns a channel receiving block device uevents. An error is
+// returned if the netlink socket is not available, in which case callers
+// should fall back to polling.
+func (m *ueventMonitor) subscribe() (chan uevent, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.started {
+		m.started = true
+		m.err = m.open()
+		if m.err == nil {
+			go m.run()
+		} else {
+			log.Warnf("Kernel uevents not available, falling back to polling: %s", m.err)
+		}
+	}
+
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	ch := make(chan uevent, 16)
+	m.subscribers[ch] = struct{}{}
+	return ch, nil
+}
+
+func (m *ueventMonitor) unsubscribe(ch chan uevent) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.subscribers, ch)
+}
+
+func (m *ueventMonitor) open() error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+
+	addr := &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to bind netlink socket: %w", err)
+	}
+
+	m.fd = fd
+	return nil
+}
+
+func (m *ueventMonitor) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := unix.Recvfrom(m.fd, buf, 0)
+		if err != nil {
+			if err == unix.EINTR || err == unix.ENOBUFS {
+				continue
+			}
+			log.Errorf("Kernel uevent monitor stopped: %s", err)
+			return
+		}
+
+		ev, ok := parseUevent(buf[:n])
+		if !ok || ev.Subsystem != "block" {
+			continue
+		}
+		log.Debugf("uevent: %s %s", ev.Action, ev.DevName)
+
+		m.mutex.Lock()
+		for ch := range m.subscribers {
+			select {
+			case ch <- ev:
+			default:
+				// subscribers re-check the device on every event, so
+				// dropping one while the channel is full loses nothing
+			}
+		}
+		m.mutex.Unlock()
+	}
+}
+
+// parseUevent parses a kernel uevent message of the form
+// "action@devpath\0KEY=value\0KEY=value..."
+func parseUevent(msg []byte) (uevent, bool) {
+	fields := bytes.Split(msg, []byte{0})
+	if len(fields) < 2 || !bytes.Contains(fields[0], []byte("@")) {
+		return uevent{}, false
+	}
+
+	ev := uevent{}
+	for _, field := range fields[1:] {
+		key, value, found := bytes.Cut(field, []byte("="))
+		if !found {
+			continue
+		}
+		switch string(key) {
+		case "ACTION":
+			ev.Action = string(value)
+		case "SUBSYSTEM":
+			ev.Subsystem = string(value)
+		case "DEVNAME":
+			ev.DevName = string(value)
+		}
+	}
+	return ev, ev.Action != ""
+}
+
+// rescanSCSIHosts asks every SCSI host to rescan its bus, which makes the
+// kernel pick up a hot-plugged volume it missed
+func rescanSCSIHosts() error {
+	hosts, err := filepath.Glob("/sys/class/scsi_host/host*/scan")
+	if err != nil {
+		return err
+	}
+
+	for _, scan := range hosts {
+		log.Infof("Rescanning SCSI host %s", filepath.Base(filepath.Dir(scan)))
+		if err := os.WriteFile(scan, []byte("- - -"), 0o200); err != nil {
+			return fmt.Errorf("failed to rescan %s: %w", scan, err)
+		}
+	}
+	return nil
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/docker/go-plugins-helpers/volume"
@@ -12,17 +14,106 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// devicePollInterval is how often device files are checked when kernel
+	// uevents are not available
+	devicePollInterval = time.Second
+
+	// deviceEventPollInterval is the safety-net check interval while uevents
+	// are being received
+	deviceEventPollInterval = 5 * time.Second
+
+	// deviceSettleInterval and deviceSettleChecks bound the quick checks made
+	// after a uevent while udev creates the by-id link
+	deviceSettleInterval = 100 * time.Millisecond
+	deviceSettleChecks   = 20
+
+	// deviceRescanDelay is how long to wait for a freshly attached device
+	// before asking the SCSI hosts to rescan
+	deviceRescanDelay = 15 * time.Second
+)
+
 // waitForDeviceFileExists waits until path devicePath becomes available or
 // times out.
 func waitForDeviceFileExists(devicePath string, waitSeconds int) error {
-	return waitForCondition(waitSeconds, 1, func() bool {
-		// found, then break
-		if _, err := os.Stat(devicePath); !os.IsNotExist(err) {
-			return true // condition met
+	return waitForDeviceFile(devicePath, true, waitSeconds)
+}
+
+// waitForDeviceFileRemoved waits until path devicePath disappears or times
+// out.
+func waitForDeviceFileRemoved(devicePath string, waitSeconds int) error {
+	return waitForDeviceFile(devicePath, false, waitSeconds)
+}
+
+// waitForDeviceFile waits for devicePath to appear (or disappear) using
+// kernel block device uevents, falling back to polling when they are not
+// available.
+func waitForDeviceFile(devicePath string, present bool, waitSeconds int) error {
+	check := func() bool {
+		_, err := os.Stat(devicePath)
+		return os.IsNotExist(err) != present
+	}
+
+	if check() {
+		return nil
+	}
+
+	state := "available"
+	if !present {
+		state = "removed"
+	}
+	log.Infof("Waiting for device %s to be %s", devicePath, state)
+
+	interval := devicePollInterval
+	events, err := blockDeviceEvents.subscribe()
+	if err == nil {
+		defer blockDeviceEvents.unsubscribe(events)
+		interval = deviceEventPollInterval
+	}
+
+	poll := time.NewTicker(interval)
+	defer poll.Stop()
+
+	timeout := time.NewTimer(time.Duration(waitSeconds) * time.Second)
+	defer timeout.Stop()
+
+	var rescan <-chan time.Time
+	if present {
+		rescanTimer := time.NewTimer(deviceRescanDelay)
+		defer rescanTimer.Stop()
+		rescan = rescanTimer.C
+	}
+
+	var settle <-chan time.Time
+	settleChecks := 0
+
+	for {
+		select {
+		case ev := <-events:
+			log.Debugf("Got %s uevent for %s while waiting for %s", ev.Action, ev.DevName, devicePath)
+			settleChecks = deviceSettleChecks
+			settle = time.After(deviceSettleInterval)
+		case <-settle:
+			settle = nil
+			if settleChecks--; settleChecks > 0 {
+				settle = time.After(deviceSettleInterval)
+			}
+		case <-poll.C:
+		case <-rescan:
+			rescan = nil
+			log.Warnf("Device %s did not appear within %s, rescanning SCSI hosts", devicePath, deviceRescanDelay)
+			if err := rescanSCSIHosts(); err != nil {
+				log.Warnf("Failed to rescan SCSI hosts: %s", err)
+			}
+		case <-timeout.C:
+			return fmt.Errorf("timeout waiting for device %s to be %s", devicePath, state)
 		}
-		log.Infof("Waiting for device %s to be available", devicePath)
-		return false
-	})
+
+		if check() {
+			log.Infof("Device %s is %s", devicePath, state)
+			return nil
+		}
+	}
 }
 
 func waitForLinodeVolumeDetachment(linodeAPI linodego.Client, volumeID, timeout int) error {
@@ -54,7 +145,7 @@ func waitForCondition(waitSeconds int, intervalSeconds int, check func() bool) e
 // linodeVolumeToDockerVolume converts a linode volume to a docker volume
 func linodeVolumeToDockerVolume(lv linodego.Volume, mp string) *volume.Volume {
 	v := &volume.Volume{
-		Name:       lv.Label,
+		Name:       volumeName(lv.Label),
 		Mountpoint: mp,
 		Status:     make(map[string]interface{}),
 	}
@@ -63,3 +154,33 @@ func linodeVolumeToDockerVolume(lv linodego.Volume, mp string) *volume.Volume {
 	}
 	return v
 }
+
+// hasTag returns whether tags contains tag
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTagPrefix returns whether tags contains a tag starting with prefix
+func hasTagPrefix(tags []string, prefix string) bool {
+	for _, t := range tags {
+		if strings.HasPrefix(t, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readTrimmedFile returns the content of a small file such as a sysfs or
+// procfs attribute, without surrounding whitespace
+func readTrimmedFile(path string) (string, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(b)), true
+}